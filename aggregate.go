@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+)
+
+// modes of aggregation
+const (
+	aggregateCount = "count" // number of results
+	aggregateSum   = "sum"   // sum of the values
+	aggregateMin   = "min"   // smallest value
+	aggregateMax   = "max"   // largest value
+)
+
+// validAggregate returns true for known modes of aggregation.
+func validAggregate(mode string) bool {
+	switch mode {
+	case aggregateCount, aggregateSum, aggregateMin, aggregateMax:
+		return true
+	}
+	return false
+}
+
+// an aggregated series
+type group struct {
+	labels []string
+	value  float64
+}
+
+// An aggregation combines the values of all results of a metric with the same label values
+// into a single series.
+type aggregation struct {
+	m      *Metric
+	groups map[string]*group
+	order  []string // keys of the groups in order of their first result
+}
+
+func newAggregation(m *Metric) *aggregation {
+	return &aggregation{m: m, groups: make(map[string]*group)}
+}
+
+// add adds the value of a result with the given label values.
+func (a *aggregation) add(labels []string, value float64) {
+	key := strings.Join(labels, "\xff")
+
+	g, ok := a.groups[key]
+	if !ok {
+		g = &group{labels: labels, value: value}
+		if a.m.Aggregate == aggregateCount {
+			g.value = 1
+		}
+		a.groups[key] = g
+		a.order = append(a.order, key)
+		return
+	}
+
+	switch a.m.Aggregate {
+	case aggregateCount:
+		g.value++
+	case aggregateSum:
+		g.value += value
+	case aggregateMin:
+		g.value = min(g.value, value)
+	case aggregateMax:
+		g.value = max(g.value, value)
+	}
+}
+
+// addEmpty adds a group without results for the label values, so a count of 0 is reported for them.
+func (a *aggregation) addEmpty(labels []string) {
+	key := strings.Join(labels, "\xff")
+
+	if _, ok := a.groups[key]; ok {
+		return
+	}
+	a.groups[key] = &group{labels: labels}
+	a.order = append(a.order, key)
+}
+
+// report adds a series for each group to the guard.
+func (a *aggregation) report(guard *seriesGuard) {
+	for _, key := range a.order {
+		g := a.groups[key]
+		guard.add(a.m.MetricType, g.value, g.labels)
+	}
+}
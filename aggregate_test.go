@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/dekarl/fritzbox_exporter/fritzbox_upnp/fake"
+)
+
+func TestAggregation(t *testing.T) {
+	// values of the results with their label values
+	type result struct {
+		labels string
+		value  float64
+	}
+	results := []result{{"802.11", 3}, {"Ethernet", 5}, {"802.11", -1}, {"802.11", 7}}
+
+	tests := []struct {
+		mode string
+		want []string
+	}{
+		{aggregateCount, []string{"802.11=3", "Ethernet=1"}},
+		{aggregateSum, []string{"802.11=9", "Ethernet=5"}},
+		{aggregateMin, []string{"802.11=-1", "Ethernet=5"}},
+		{aggregateMax, []string{"802.11=7", "Ethernet=5"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			a := newAggregation(&Metric{Aggregate: tt.mode})
+			a.addEmpty([]string{"HomePlug"})
+			for _, r := range results {
+				a.add([]string{r.labels}, r.value)
+			}
+
+			var got []string
+			for _, key := range a.order {
+				g := a.groups[key]
+				got = append(got, fmt.Sprintf("%s=%g", strings.Join(g.labels, ","), g.value))
+			}
+			// the empty group is reported first with 0
+			want := append([]string{"HomePlug=0"}, tt.want...)
+			if strings.Join(got, " ") != strings.Join(want, " ") {
+				t.Errorf("aggregated %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestAggregationReport(t *testing.T) {
+	m := &Metric{Aggregate: aggregateSum, MetricType: prometheus.GaugeValue}
+	m.PromDesc.FqName = "test_sum"
+	m.PromDesc.VarLabels = []string{"InterfaceType"}
+	m.Desc = prometheus.NewDesc("test_sum", "sum", []string{"interfacetype"}, nil)
+
+	a := newAggregation(m)
+	a.add([]string{"Ethernet"}, 2)
+	a.add([]string{"802.11"}, 1)
+	a.add([]string{"Ethernet"}, 3)
+
+	ch := make(chan prometheus.Metric, 10)
+	guard := newSeriesGuard(&FritzboxCollector{}, ch, slog.New(slog.NewTextHandler(io.Discard, nil)), nil)
+	a.report(guard)
+	guard.flush(m)
+
+	want := []string{"Ethernet=5", "802.11=1"}
+	if got := collectedSeries(t, ch); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("reported %v, want %v", got, want)
+	}
+}
+
+func TestCountWithoutMatches(t *testing.T) {
+	tests := []struct {
+		name      string
+		varLabels string
+		hosts     []map[string]string
+		want      map[string]float64 // counts by interface type, "" without the label
+	}{
+		{
+			name:      "filtered label values",
+			varLabels: `"gateway", "InterfaceType"`,
+			hosts: []map[string]string{
+				{"HostName": "laptop", "Active": "1", "InterfaceType": "802.11"},
+				{"HostName": "nas", "Active": "0", "InterfaceType": "Ethernet"},
+			},
+			want: map[string]float64{"802.11": 1, "ethernet": 0}, // label values are lowercase
+		},
+		{
+			name:      "no active host",
+			varLabels: `"gateway"`,
+			hosts: []map[string]string{
+				{"HostName": "nas", "Active": "0", "InterfaceType": "Ethernet"},
+			},
+			want: map[string]float64{"": 0},
+		},
+		{
+			name:      "empty list",
+			varLabels: `"gateway"`,
+			want:      map[string]float64{"": 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fc, _ := startCollector(t, "secret", func(sc *fake.Scenario) {
+				sc.Lists["/devicehostlist.lua"] = tt.hosts
+			})
+
+			metrics, err := parseMetrics([]byte(`[{
+				"service": "urn:dslforum-org:service:Hosts:1",
+				"action": "X_AVM-DE_GetHostListPath",
+				"source": "list",
+				"listPath": "X_AVM-DE_HostListPath",
+				"filter": [{"result": "Active", "value": "1"}],
+				"aggregate": "count",
+				"promDesc": {"fqName": "test_hosts_active", "help": "active hosts", "varLabels": [`+tt.varLabels+`]},
+				"promType": "GaugeValue"
+			}]`), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fc.SetMetrics(metrics)
+
+			families := scrapeMetrics(t, fc, "")
+			for interfaceType, count := range tt.want {
+				labels := map[string]string{"gateway": "fritz.box"}
+				if interfaceType != "" {
+					labels["interfacetype"] = interfaceType
+				}
+				expectValue(t, families, "test_hosts_active", labels, count)
+			}
+			if n := len(families["test_hosts_active"].GetMetric()); n != len(tt.want) {
+				t.Errorf("%d series reported, want %d", n, len(tt.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+// Simulate a FRITZ!Box described by a scenario file, e.g. to try the exporter without hardware.
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/namsral/flag"
+
+	"gitlab.com/dekarl/fritzbox_exporter/fritzbox_upnp/fake"
+)
+
+var (
+	flagScenario = flag.String("scenario", "fritzbox_upnp/fake/scenario.json", "The scenario describing the simulated FRITZ!Box")
+	flagAddr     = flag.String("listen-address", "127.0.0.1:49000", "The address to listen on for requests")
+)
+
+func main() {
+	flag.Parse()
+
+	scenario, err := fake.LoadScenario(*flagScenario)
+	if err != nil {
+		slog.Error("cannot load scenario", "err", err)
+		os.Exit(1)
+	}
+
+	server, err := fake.NewServer(scenario)
+	if err != nil {
+		slog.Error("invalid scenario", "file", *flagScenario, "err", err)
+		os.Exit(1)
+	}
+
+	slog.Info("simulating FRITZ!Box", "address", *flagAddr, "services", len(scenario.Services))
+	err = http.ListenAndServe(*flagAddr, server)
+	slog.Error("cannot serve requests", "err", err)
+	os.Exit(1)
+}
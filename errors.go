@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	upnp "gitlab.com/dekarl/fritzbox_exporter/fritzbox_upnp"
+)
+
+// reasons of collection errors
+const (
+	reasonNetwork       = "network"        // the FRITZ!Box could not be reached
+	reasonTimeout       = "timeout"        // a request to the FRITZ!Box timed out
+	reasonHTTPStatus    = "http_status"    // unexpected HTTP status, the code is the status
+	reasonUnauthorized  = "unauthorized"   // wrong or missing credentials
+	reasonAuthBlocked   = "auth_blocked"   // no credentials sent, since the FRITZ!Box rejected them recently
+	reasonSoapFault     = "soap_fault"     // the action failed, the code is the UPnP error code
+	reasonParse         = "parse"          // the response could not be parsed
+	reasonMissingResult = "missing_result" // a result used by the metric is missing
+	reasonTypeMismatch  = "type_mismatch"  // a result cannot be converted into a metric value
+	reasonUnknownAction = "unknown_action" // the service or action does not exist on the FRITZ!Box
+	reasonArgument      = "argument"       // the arguments of the call do not match the action
+	reasonOther         = "other"
+)
+
+var (
+	errMissingResult = errors.New("missing result")
+	errTypeMismatch  = errors.New("type mismatch")
+	errUnknownAction = errors.New("unknown action")
+
+	// returned for actions not called, since the FRITZ!Box does not support them
+	errSkippedUnsupported = errors.New("skipped unsupported action")
+)
+
+var (
+	collectErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "fritzbox_exporter_collect_errors",
+		Help: "Number of collection errors by service, action and reason. The code is the HTTP status or the UPnP error code.",
+	}, []string{"service", "action", "reason", "code"})
+
+	actionUnsupportedDesc = prometheus.NewDesc(
+		"fritzbox_exporter_action_unsupported",
+		"Set to 1 for each action the FRITZ!Box does not support. These actions are not called for an hour.",
+		[]string{"service", "action"}, nil)
+	upDesc = prometheus.NewDesc(
+		"fritzbox_up",
+		"Whether the services of the FRITZ!Box are loaded and the last scrape got at least one answer.",
+		nil, nil)
+	scrapeDurationDesc = prometheus.NewDesc(
+		"fritzbox_scrape_duration_seconds",
+		"Duration of the collection of the metrics of the FRITZ!Box.",
+		nil, nil)
+)
+
+// classifyError returns the reason of an error and the HTTP status or UPnP error code if available.
+func classifyError(err error) (string, string) {
+	var netErr net.Error
+	var faultErr *upnp.SoapFaultError
+	var statusErr *upnp.HTTPStatusError
+	var syntaxErr *xml.SyntaxError
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return reasonTimeout, ""
+	case errors.As(err, &faultErr):
+		return reasonSoapFault, strconv.Itoa(faultErr.Code)
+	case errors.Is(err, upnp.ErrAuthBlocked):
+		return reasonAuthBlocked, strconv.Itoa(http.StatusUnauthorized)
+	case errors.Is(err, upnp.ErrUnauthorized):
+		return reasonUnauthorized, strconv.Itoa(http.StatusUnauthorized)
+	case errors.As(err, &statusErr):
+		return reasonHTTPStatus, strconv.Itoa(statusErr.StatusCode)
+	case errors.Is(err, upnp.ErrInvalidSOAPResponse), errors.As(err, &syntaxErr):
+		return reasonParse, ""
+	case errors.Is(err, errMissingResult):
+		return reasonMissingResult, ""
+	case errors.Is(err, errTypeMismatch):
+		return reasonTypeMismatch, ""
+	case errors.Is(err, errUnknownAction):
+		return reasonUnknownAction, ""
+	case errors.Is(err, upnp.ErrArgumentMismatch):
+		return reasonArgument, ""
+	case errors.As(err, &netErr):
+		return reasonNetwork, ""
+	}
+
+	return reasonOther, ""
+}
+
+// countError counts an error of the action of the service.
+func countError(service string, action string, err error) {
+	reason, code := classifyError(err)
+	collectErrors.WithLabelValues(service, action, reason, code).Inc()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	upnp "gitlab.com/dekarl/fritzbox_exporter/fritzbox_upnp"
+)
+
+// operators of filters
+const (
+	filterEq    = "eq"    // equal, numerically if both values are numbers
+	filterNe    = "ne"    // not equal
+	filterRegex = "regex" // the result matches the pattern
+	filterLt    = "lt"    // numerically less than
+	filterLe    = "le"    // numerically less than or equal
+	filterGt    = "gt"    // numerically greater than
+	filterGe    = "ge"    // numerically greater than or equal
+)
+
+// A Filter selects the results of an action which are reported.
+type Filter struct {
+	Result string `json:"result"` // result to compare
+	Op     string `json:"op"`     // operator, eq if not given
+	Value  string `json:"value"`  // value or pattern to compare the result with
+
+	regexp *regexp.Regexp
+	number float64
+}
+
+// init checks the filter and prepares it for use.
+func (f *Filter) init() error {
+	if f.Result == "" {
+		return fmt.Errorf("filter without result")
+	}
+
+	var err error
+	switch f.Op {
+	case "":
+		f.Op = filterEq
+	case filterEq, filterNe:
+	case filterRegex:
+		f.regexp, err = regexp.Compile(f.Value)
+		if err != nil {
+			return err
+		}
+	case filterLt, filterLe, filterGt, filterGe:
+		f.number, err = strconv.ParseFloat(f.Value, 64)
+		if err != nil {
+			return fmt.Errorf("%s filter needs a number: %s", f.Op, err)
+		}
+	default:
+		return fmt.Errorf("unknown filter operator %q", f.Op)
+	}
+
+	return nil
+}
+
+// match returns true if the result passes the filter.
+func (f *Filter) match(result upnp.Result) (bool, error) {
+	val, ok := result[f.Result]
+	if !ok {
+		return false, fmt.Errorf("%w: filter result %s", errMissingResult, f.Result)
+	}
+
+	switch f.Op {
+	case filterEq, filterNe:
+		equal := fmt.Sprintf("%v", val) == f.Value
+		if n, err := toFloat(val); err == nil {
+			if v, err := strconv.ParseFloat(f.Value, 64); err == nil {
+				equal = n == v
+			}
+		}
+		return equal == (f.Op == filterEq), nil
+
+	case filterRegex:
+		return f.regexp.MatchString(fmt.Sprintf("%v", val)), nil
+	}
+
+	n, err := toFloat(val)
+	if err != nil {
+		return false, fmt.Errorf("%w: %s filter on %s: %s", errTypeMismatch, f.Op, f.Result, err)
+	}
+
+	switch f.Op {
+	case filterLt:
+		return n < f.number, nil
+	case filterLe:
+		return n <= f.number, nil
+	case filterGt:
+		return n > f.number, nil
+	case filterGe:
+		return n >= f.number, nil
+	}
+
+	return false, fmt.Errorf("unknown filter operator %q", f.Op)
+}
+
+// filter returns true if the result passes all filters of the metric.
+func (m *Metric) filter(result upnp.Result) (bool, error) {
+	for _, f := range m.Filter {
+		ok, err := f.match(result)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
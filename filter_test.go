@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	upnp "gitlab.com/dekarl/fritzbox_exporter/fritzbox_upnp"
+)
+
+func TestFilterInit(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  Filter
+		wantErr bool
+	}{
+		{"eq by default", Filter{Result: "Active", Value: "1"}, false},
+		{"regex", Filter{Result: "HostName", Op: filterRegex, Value: "^tv-"}, false},
+		{"number", Filter{Result: "Rssi", Op: filterGe, Value: "-70"}, false},
+		{"no result", Filter{Op: filterEq, Value: "1"}, true},
+		{"invalid regex", Filter{Result: "HostName", Op: filterRegex, Value: "("}, true},
+		{"comparison without number", Filter{Result: "Rssi", Op: filterLt, Value: "low"}, true},
+		{"unknown operator", Filter{Result: "Active", Op: "like", Value: "1"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := tt.filter
+			err := f.init()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("init() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && f.Op == "" {
+				t.Errorf("operator not set")
+			}
+		})
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	result := upnp.Result{
+		"Active":        true,
+		"HostName":      "tv-living-room",
+		"InterfaceType": "802.11",
+		"Rssi":          int64(-65),
+		"Speed":         uint64(100),
+		"Ratio":         "0.5",
+	}
+
+	tests := []struct {
+		op      string
+		result  string
+		value   string
+		want    bool
+		wantErr error
+	}{
+		{filterEq, "InterfaceType", "802.11", true, nil},
+		{filterEq, "InterfaceType", "Ethernet", false, nil},
+		{filterEq, "Active", "1", true, nil},
+		{filterEq, "Speed", "100.0", true, nil}, // compared as numbers
+		{filterEq, "Ratio", "0.50", true, nil},
+		{filterNe, "InterfaceType", "Ethernet", true, nil},
+		{filterNe, "Active", "1", false, nil},
+		{filterRegex, "HostName", "^tv-", true, nil},
+		{filterRegex, "HostName", "^nas", false, nil},
+		{filterRegex, "Speed", "^1", true, nil}, // numbers are matched as text
+		{filterLt, "Rssi", "-70", false, nil},
+		{filterLe, "Rssi", "-65", true, nil},
+		{filterGt, "Rssi", "-70", true, nil},
+		{filterGe, "Speed", "101", false, nil},
+		{filterGe, "Ratio", "0.5", true, nil},
+		{filterEq, "Unknown", "1", false, errMissingResult},
+		{filterLt, "HostName", "1", false, errTypeMismatch},
+	}
+
+	for _, tt := range tests {
+		f := &Filter{Result: tt.result, Op: tt.op, Value: tt.value}
+		if err := f.init(); err != nil {
+			t.Fatalf("%s %s %s: %v", tt.result, tt.op, tt.value, err)
+		}
+
+		got, err := f.match(result)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s %s %s: error %v, want %v", tt.result, tt.op, tt.value, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("%s %s %s = %v, want %v", tt.result, tt.op, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestMetricFilter(t *testing.T) {
+	m := &Metric{Filter: []*Filter{
+		{Result: "Active", Value: "1"},
+		{Result: "InterfaceType", Op: filterNe, Value: "Ethernet"},
+	}}
+	for _, f := range m.Filter {
+		if err := f.init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		result  upnp.Result
+		want    bool
+		wantErr bool
+	}{
+		{upnp.Result{"Active": "1", "InterfaceType": "802.11"}, true, false},
+		{upnp.Result{"Active": "0", "InterfaceType": "802.11"}, false, false},
+		{upnp.Result{"Active": "1", "InterfaceType": "Ethernet"}, false, false},
+		{upnp.Result{"Active": "1"}, false, true},
+	}
+
+	for _, tt := range tests {
+		got, err := m.filter(tt.result)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("filter(%v) error = %v, want error %v", tt.result, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("filter(%v) = %v, want %v", tt.result, got, tt.want)
+		}
+	}
+}
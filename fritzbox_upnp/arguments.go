@@ -0,0 +1,121 @@
+package fritzbox_upnp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maximum values of the unsigned data types, ui4 is not limited since it can contain values greater than 2^32
+var maxUnsigned = map[string]uint64{
+	"ui1": 1<<8 - 1,
+	"ui2": 1<<16 - 1,
+}
+
+// encodeArguments checks the arguments of a call against the input arguments of the action and
+// returns them as XML elements in the order of the action description. Nil arguments are ignored.
+func (a *Action) encodeArguments(args []*ActionArgument) (string, error) {
+	values := make(map[string]string)
+	for _, arg := range args {
+		if arg == nil {
+			continue
+		}
+
+		in, ok := a.ArgumentMap[arg.Name]
+		if !ok || in.Direction != "in" {
+			return "", fmt.Errorf("%w: %s has no input argument %s", ErrArgumentMismatch, a.Name, arg.Name)
+		}
+		if _, ok := values[arg.Name]; ok {
+			return "", fmt.Errorf("%w: argument %s of %s given twice", ErrArgumentMismatch, arg.Name, a.Name)
+		}
+
+		value, err := formatArgument(in, arg.Value)
+		if err != nil {
+			return "", fmt.Errorf("%w: argument %s of %s: %s", ErrArgumentMismatch, arg.Name, a.Name, err)
+		}
+		values[arg.Name] = value
+	}
+
+	var buf bytes.Buffer
+	for _, in := range a.Arguments {
+		if in.Direction != "in" {
+			continue
+		}
+
+		value, ok := values[in.Name]
+		if !ok {
+			return "", fmt.Errorf("%w: %s requires input argument %s", ErrArgumentMismatch, a.Name, in.Name)
+		}
+
+		var escaped bytes.Buffer
+		xml.EscapeText(&escaped, []byte(value))
+		buf.WriteString(fmt.Sprintf(SoapActionParamXML, in.Name, escaped.String(), in.Name))
+	}
+
+	return buf.String(), nil
+}
+
+// formatArgument converts the value into the representation of the data type of the argument.
+func formatArgument(arg *Argument, value interface{}) (string, error) {
+	s := fmt.Sprintf("%v", value)
+
+	sv := arg.StateVariable
+	if sv == nil {
+		return s, nil
+	}
+
+	switch sv.DataType {
+	case "boolean":
+		switch strings.ToLower(s) {
+		case "1", "true", "yes":
+			return "1", nil
+		case "0", "false", "no":
+			return "0", nil
+		}
+		return "", fmt.Errorf("%q is no boolean", s)
+
+	case "ui1", "ui2", "ui4":
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("%q is no unsigned integer", s)
+		}
+		if limit, ok := maxUnsigned[sv.DataType]; ok && n > limit {
+			return "", fmt.Errorf("%d exceeds the range of %s", n, sv.DataType)
+		}
+		return strconv.FormatUint(n, 10), nil
+
+	case "i4":
+		n, err := strconv.ParseInt(s, 10, 32)
+		if err != nil {
+			return "", fmt.Errorf("%q is no 32 bit integer", s)
+		}
+		return strconv.FormatInt(n, 10), nil
+
+	case "string":
+		if len(sv.AllowedValues) == 0 {
+			return s, nil
+		}
+		for _, allowed := range sv.AllowedValues {
+			if s == allowed {
+				return s, nil
+			}
+		}
+		return "", fmt.Errorf("%q is not one of %s", s, strings.Join(sv.AllowedValues, ", "))
+	}
+
+	// data types we don't check yet
+	return s, nil
+}
+
+// argumentsLogValue returns the arguments of a call as text for log messages.
+func argumentsLogValue(args []*ActionArgument) string {
+	var parts []string
+	for _, arg := range args {
+		if arg != nil {
+			parts = append(parts, fmt.Sprintf("%s=%v", arg.Name, arg.Value))
+		}
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,152 @@
+package fritzbox_upnp
+
+import (
+	"errors"
+	"testing"
+)
+
+// testAction returns an action with the input arguments of the given data types and an output argument.
+func testAction(types ...string) *Action {
+	a := &Action{Name: "SetTest", ArgumentMap: make(map[string]*Argument)}
+	for i := 0; i+1 < len(types); i += 2 {
+		arg := &Argument{Name: types[i], Direction: "in", StateVariable: &StateVariable{DataType: types[i+1]}}
+		a.Arguments = append(a.Arguments, arg)
+	}
+	a.Arguments = append(a.Arguments, &Argument{Name: "NewResult", Direction: "out", StateVariable: &StateVariable{DataType: "string"}})
+
+	for _, arg := range a.Arguments {
+		a.ArgumentMap[arg.Name] = arg
+	}
+	return a
+}
+
+func TestEncodeArguments(t *testing.T) {
+	a := testAction("NewIndex", "ui2", "NewEnable", "boolean", "NewName", "string")
+
+	tests := []struct {
+		name    string
+		args    []*ActionArgument
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "order of the action description",
+			args: []*ActionArgument{{"NewName", "tv"}, {"NewEnable", true}, {"NewIndex", 3}},
+			want: "<NewIndex>3</NewIndex><NewEnable>1</NewEnable><NewName>tv</NewName>",
+		},
+		{
+			name: "escaping",
+			args: []*ActionArgument{{"NewIndex", "0"}, {"NewEnable", "no"}, {"NewName", `<a href="x">&'`}},
+			want: "<NewIndex>0</NewIndex><NewEnable>0</NewEnable><NewName>&lt;a href=&#34;x&#34;&gt;&amp;&#39;</NewName>",
+		},
+		{
+			name: "nil arguments ignored",
+			args: []*ActionArgument{nil, {"NewIndex", uint64(1)}, {"NewEnable", "TRUE"}, nil, {"NewName", ""}},
+			want: "<NewIndex>1</NewIndex><NewEnable>1</NewEnable><NewName></NewName>",
+		},
+		{
+			name:    "missing argument",
+			args:    []*ActionArgument{{"NewIndex", 1}, {"NewEnable", true}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown argument",
+			args:    []*ActionArgument{{"NewIndex", 1}, {"NewEnable", true}, {"NewName", "tv"}, {"NewColor", "red"}},
+			wantErr: true,
+		},
+		{
+			name:    "output argument",
+			args:    []*ActionArgument{{"NewIndex", 1}, {"NewEnable", true}, {"NewName", "tv"}, {"NewResult", "ok"}},
+			wantErr: true,
+		},
+		{
+			name:    "argument given twice",
+			args:    []*ActionArgument{{"NewIndex", 1}, {"NewIndex", 2}, {"NewEnable", true}, {"NewName", "tv"}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid value",
+			args:    []*ActionArgument{{"NewIndex", -1}, {"NewEnable", true}, {"NewName", "tv"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := a.encodeArguments(tt.args)
+			if tt.wantErr {
+				if !errors.Is(err, ErrArgumentMismatch) {
+					t.Errorf("encodeArguments() error = %v, want %v", err, ErrArgumentMismatch)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("encodeArguments() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeNoArguments(t *testing.T) {
+	got, err := testAction().encodeArguments(nil)
+	if err != nil || got != "" {
+		t.Errorf("encodeArguments(nil) = %q, %v", got, err)
+	}
+}
+
+func TestFormatArgument(t *testing.T) {
+	tests := []struct {
+		dataType string
+		allowed  []string
+		value    interface{}
+		want     string
+		wantErr  bool
+	}{
+		{"boolean", nil, true, "1", false},
+		{"boolean", nil, false, "0", false},
+		{"boolean", nil, "Yes", "1", false},
+		{"boolean", nil, 0, "0", false},
+		{"boolean", nil, "maybe", "", true},
+		{"ui1", nil, 255, "255", false},
+		{"ui1", nil, 256, "", true},
+		{"ui2", nil, "0065535", "65535", false},
+		{"ui2", nil, 65536, "", true},
+		{"ui4", nil, uint64(1) << 33, "8589934592", false}, // counters of the FRITZ!Box exceed 32 bit
+		{"ui4", nil, -1, "", true},
+		{"ui4", nil, 1.5, "", true},
+		{"i4", nil, -42, "-42", false},
+		{"i4", nil, int64(1) << 31, "", true},
+		{"i4", nil, "ten", "", true},
+		{"string", nil, 42, "42", false},
+		{"string", []string{"Ethernet", "802.11"}, "802.11", "802.11", false},
+		{"string", []string{"Ethernet", "802.11"}, "ethernet", "", true},
+		{"dateTime", nil, "2021-03-01T12:00:00", "2021-03-01T12:00:00", false}, // not checked
+	}
+
+	for _, tt := range tests {
+		arg := &Argument{Name: "NewValue", StateVariable: &StateVariable{DataType: tt.dataType, AllowedValues: tt.allowed}}
+		got, err := formatArgument(arg, tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("formatArgument(%s, %v) error = %v, want error %v", tt.dataType, tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("formatArgument(%s, %v) = %q, want %q", tt.dataType, tt.value, got, tt.want)
+		}
+	}
+
+	// arguments without state variable are passed as they are
+	if got, err := formatArgument(&Argument{Name: "NewValue"}, -1); err != nil || got != "-1" {
+		t.Errorf("formatArgument() without state variable = %q, %v", got, err)
+	}
+}
+
+func TestArgumentsLogValue(t *testing.T) {
+	got := argumentsLogValue([]*ActionArgument{{"NewIndex", 1}, nil, {"NewName", "tv"}})
+	if want := "NewIndex=1 NewName=tv"; got != want {
+		t.Errorf("argumentsLogValue() = %q, want %q", got, want)
+	}
+}
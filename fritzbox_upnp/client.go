@@ -0,0 +1,186 @@
+package fritzbox_upnp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// An Option configures the HTTP client of a Root.
+type Option func(*clientConfig) error
+
+type clientConfig struct {
+	timeout   time.Duration
+	tlsConfig *tls.Config
+	proxy     func(*http.Request) (*url.URL, error)
+	client    *http.Client
+	logger    *slog.Logger
+	hooks     Hooks
+
+	authBackoff    time.Duration
+	maxAuthBackoff time.Duration
+
+	middlewares []Middleware
+}
+
+// WithTimeout sets the timeout for each HTTP request to the device.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *clientConfig) error {
+		c.timeout = timeout
+		return nil
+	}
+}
+
+// WithInsecureSkipVerify disables the verification of the TLS certificate of the device.
+// The FRITZ!Box uses a self signed certificate by default.
+func WithInsecureSkipVerify() Option {
+	return func(c *clientConfig) error {
+		c.tlsConfig.InsecureSkipVerify = true
+		return nil
+	}
+}
+
+// WithRootCAs sets the certificate pool used to verify the TLS certificate of the device.
+func WithRootCAs(pool *x509.CertPool) Option {
+	return func(c *clientConfig) error {
+		c.tlsConfig.RootCAs = pool
+		return nil
+	}
+}
+
+// WithCAFile reads a PEM encoded CA bundle used to verify the TLS certificate of the device.
+func WithCAFile(file string) Option {
+	return func(c *clientConfig) error {
+		pem, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", file)
+		}
+
+		c.tlsConfig.RootCAs = pool
+		return nil
+	}
+}
+
+// WithProxy sends all requests to the device through the given proxy.
+func WithProxy(proxyUrl string) Option {
+	return func(c *clientConfig) error {
+		u, err := url.Parse(proxyUrl)
+		if err != nil {
+			return err
+		}
+
+		c.proxy = http.ProxyURL(u)
+		return nil
+	}
+}
+
+// WithHTTPClient uses the given client for all requests to the device. The timeout, TLS and
+// proxy options are ignored if a client is given, middlewares wrap the transport of the client.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *clientConfig) error {
+		if client == nil {
+			return errors.New("http client must not be nil")
+		}
+
+		c.client = client
+		return nil
+	}
+}
+
+// WithLogger sets the logger for messages about loading the services and calling actions.
+// The default logger is used if not given.
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *clientConfig) error {
+		if logger == nil {
+			return errors.New("logger must not be nil")
+		}
+
+		c.logger = logger
+		return nil
+	}
+}
+
+// WithAuthBackoff sets the time no credentials are sent after the device rejected them. The time
+// doubles with each further rejection up to max. Defaults to DefaultAuthBackoff and DefaultMaxAuthBackoff.
+func WithAuthBackoff(initial time.Duration, max time.Duration) Option {
+	return func(c *clientConfig) error {
+		if initial <= 0 || max < initial {
+			return fmt.Errorf("invalid auth backoff %s up to %s", initial, max)
+		}
+
+		c.authBackoff = initial
+		c.maxAuthBackoff = max
+		return nil
+	}
+}
+
+// build the HTTP client from the configuration
+func (c *clientConfig) httpClient() *http.Client {
+	if c.client != nil {
+		if len(c.middlewares) == 0 {
+			return c.client
+		}
+
+		// wrap a copy to leave the given client unchanged
+		client := *c.client
+		transport := client.Transport
+		if transport == nil {
+			transport = http.DefaultTransport
+		}
+		client.Transport = wrapTransport(transport, c.middlewares)
+		return &client
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = c.tlsConfig
+	transport.Proxy = c.proxy
+
+	return &http.Client{
+		Transport: wrapTransport(transport, c.middlewares),
+		Timeout:   c.timeout,
+	}
+}
+
+// NewRoot creates a Root for the device at baseurl with its own HTTP client and authentication state.
+// The services are not loaded until Load is called.
+func NewRoot(baseurl string, username string, password string, options ...Option) (*Root, error) {
+	config := &clientConfig{
+		tlsConfig: &tls.Config{},
+		proxy:     http.ProxyFromEnvironment,
+		logger:    slog.Default(),
+		hooks:     NopHooks{},
+
+		authBackoff:    DefaultAuthBackoff,
+		maxAuthBackoff: DefaultMaxAuthBackoff,
+	}
+
+	for _, option := range options {
+		err := option(config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Root{
+		BaseUrl:  baseurl,
+		Username: username,
+		Password: password,
+		client:   config.httpClient(),
+		logger:   config.logger,
+		hooks:    config.hooks,
+
+		authBackoff:    config.authBackoff,
+		maxAuthBackoff: config.maxAuthBackoff,
+	}, nil
+}
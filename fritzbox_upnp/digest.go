@@ -0,0 +1,303 @@
+package fritzbox_upnp
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+	"time"
+
+	"gitlab.com/dekarl/fritzbox_exporter/fritzbox_upnp/internal/authparams"
+)
+
+// Default time no credentials are sent after the device rejected them, doubled with each
+// further rejection up to the maximum. The FRITZ!Box blocks logins after failed attempts.
+const (
+	DefaultAuthBackoff    = 30 * time.Second
+	DefaultMaxAuthBackoff = 30 * time.Minute
+)
+
+// digest algorithms in order of preference, see RFC 7616
+var digestAlgorithms = []string{"SHA-256-sess", "SHA-256", "MD5-sess", "MD5"}
+
+// A digestChallenge is a challenge of the device for digest authentication. It is reused for all
+// calls until the device sends a new challenge, counting the requests made with its nonce.
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string // one of digestAlgorithms
+	qop       string // "auth" or empty for servers not supporting qop (RFC 2069)
+	stale     bool   // the previous nonce was outdated, but the credentials were accepted
+
+	cnonce   string // client nonce used with this challenge
+	count    uint32 // number of requests made with the nonce
+	accepted bool   // the device answered a request made with the nonce
+}
+
+// parseDigestChallenges returns the strongest supported challenge of the WWW-Authenticate headers.
+func parseDigestChallenges(headers []string) (*digestChallenge, error) {
+	var best *digestChallenge
+	var firstErr error
+	rank := len(digestAlgorithms)
+
+	for _, header := range headers {
+		c, err := parseDigestChallenge(header)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		for i, algorithm := range digestAlgorithms {
+			if algorithm == c.algorithm && i < rank {
+				best, rank = c, i
+			}
+		}
+	}
+
+	if best == nil && firstErr != nil {
+		return nil, firstErr
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no digest challenge")
+	}
+
+	return best, nil
+}
+
+// parseDigestChallenge parses the digest challenge of a WWW-Authenticate header.
+func parseDigestChallenge(header string) (*digestChallenge, error) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	if !strings.EqualFold(scheme, "Digest") {
+		return nil, fmt.Errorf("WWW-Authenticate header is not Digest: '%s'", header)
+	}
+
+	params := authparams.Parse(rest)
+	if params["nonce"] == "" {
+		return nil, fmt.Errorf("digest challenge without nonce: '%s'", header)
+	}
+
+	c := &digestChallenge{
+		realm:  params["realm"],
+		nonce:  params["nonce"],
+		opaque: params["opaque"],
+		stale:  strings.EqualFold(params["stale"], "true"),
+	}
+
+	c.algorithm = "MD5"
+	if params["algorithm"] != "" {
+		c.algorithm = ""
+		for _, algorithm := range digestAlgorithms {
+			if strings.EqualFold(algorithm, params["algorithm"]) {
+				c.algorithm = algorithm
+			}
+		}
+		if c.algorithm == "" {
+			return nil, fmt.Errorf("digest algorithm not supported: %s", params["algorithm"])
+		}
+	}
+
+	if qop, ok := params["qop"]; ok {
+		for _, option := range strings.Split(qop, ",") {
+			if strings.TrimSpace(option) == "auth" {
+				c.qop = "auth"
+			}
+		}
+		if c.qop == "" {
+			return nil, fmt.Errorf("digest qop not supported: %s", qop)
+		}
+	}
+
+	cn := make([]byte, 8)
+	rand.Read(cn)
+	c.cnonce = hex.EncodeToString(cn)
+
+	return c, nil
+}
+
+func (c *digestChallenge) hash(parts ...string) string {
+	var h hash.Hash
+	if strings.HasPrefix(c.algorithm, "SHA-256") {
+		h = sha256.New()
+	} else {
+		h = md5.New()
+	}
+
+	h.Write([]byte(strings.Join(parts, ":")))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// authorization returns the Authorization header of the next request made with the challenge.
+// The caller has to serialize calls, since the nonce count is incremented.
+func (c *digestChallenge) authorization(method string, uri string, username string, password string) string {
+	c.count++
+	nc := fmt.Sprintf("%08x", c.count)
+
+	ha1 := c.hash(username, c.realm, password)
+	if strings.HasSuffix(c.algorithm, "-sess") {
+		ha1 = c.hash(ha1, c.nonce, c.cnonce)
+	}
+	ha2 := c.hash(method, uri)
+
+	var response string
+	if c.qop == "" {
+		response = c.hash(ha1, c.nonce, ha2)
+	} else {
+		response = c.hash(ha1, c.nonce, nc, c.cnonce, c.qop, ha2)
+	}
+
+	params := []string{
+		"username=" + authparams.Quote(username),
+		"realm=" + authparams.Quote(c.realm),
+		"nonce=" + authparams.Quote(c.nonce),
+		"uri=" + authparams.Quote(uri),
+		"algorithm=" + c.algorithm,
+		"response=" + authparams.Quote(response),
+	}
+	if c.qop != "" {
+		params = append(params, "qop="+c.qop, "nc="+nc, "cnonce="+authparams.Quote(c.cnonce))
+	}
+	if c.opaque != "" {
+		params = append(params, "opaque="+authparams.Quote(c.opaque))
+	}
+
+	return "Digest " + strings.Join(params, ", ")
+}
+
+// authorize adds the Authorization header to the request, if the root has a challenge and
+// credentials are not blocked. Returns the challenge used or nil, if the header was not added.
+// Until the device accepted a challenge, only one call at a time logs in with it. Login is true
+// for this call, which has to call endLogin when it is answered. Other calls are made without
+// credentials meanwhile and can wait for the login with waitLogin.
+func (r *Root) authorize(req *http.Request) (used *digestChallenge, login bool) {
+	r.authLock.Lock()
+	defer r.authLock.Unlock()
+
+	if r.challenge == nil || time.Now().Before(r.authBlockedUntil) {
+		return nil, false
+	}
+	if !r.challenge.accepted {
+		if r.login != nil {
+			return nil, false
+		}
+		r.login = make(chan struct{})
+		login = true
+	}
+
+	req.Header.Set("Authorization", r.challenge.authorization(req.Method, req.URL.RequestURI(), r.Username, r.Password))
+	return r.challenge, login
+}
+
+// endLogin wakes up the calls waiting for the login.
+func (r *Root) endLogin() {
+	r.authLock.Lock()
+	defer r.authLock.Unlock()
+
+	if r.login != nil {
+		close(r.login)
+		r.login = nil
+	}
+}
+
+// waitLogin waits until the current login is answered.
+func (r *Root) waitLogin(ctx context.Context) error {
+	r.authLock.Lock()
+	login := r.login
+	r.authLock.Unlock()
+
+	if login == nil {
+		return nil
+	}
+	select {
+	case <-login:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// replaceChallenge stores the challenge used for the following requests, unless another call
+// replaced the challenge used since. Used is nil for a request made without credentials.
+func (r *Root) replaceChallenge(used *digestChallenge, c *digestChallenge) {
+	r.authLock.Lock()
+	defer r.authLock.Unlock()
+
+	if r.challenge == used || r.challenge == nil {
+		r.challenge = c
+	}
+}
+
+// nonceAccepted returns whether the device answered a request made with the nonce of the challenge.
+func (r *Root) nonceAccepted(c *digestChallenge) bool {
+	r.authLock.Lock()
+	defer r.authLock.Unlock()
+	return c.accepted
+}
+
+// AuthState returns the number of logins the device rejected since it accepted the credentials
+// the last time and the time until which no credentials are sent. Failures greater than zero
+// mean that the credentials are probably wrong.
+func (r *Root) AuthState() (failures int, blockedUntil time.Time) {
+	r.authLock.Lock()
+	defer r.authLock.Unlock()
+	return r.authFailures, r.authBlockedUntil
+}
+
+// authBlocked returns the end of the backoff and true while no credentials are sent.
+func (r *Root) authBlocked() (time.Time, bool) {
+	r.authLock.Lock()
+	defer r.authLock.Unlock()
+	return r.authBlockedUntil, time.Now().Before(r.authBlockedUntil)
+}
+
+// authFailed records that the device rejected the login with the challenge and returns the end
+// of the backoff. The backoff doubles with each rejection, the challenge is forgotten. A
+// rejection is counted once per challenge, counted is false if the challenge was replaced or
+// rejected before.
+func (r *Root) authFailed(c *digestChallenge) (until time.Time, counted bool) {
+	r.authLock.Lock()
+	defer r.authLock.Unlock()
+
+	if r.challenge != c {
+		return r.authBlockedUntil, false
+	}
+
+	backoff := r.authBackoff
+	if backoff <= 0 {
+		// root not created by NewRoot
+		backoff = DefaultAuthBackoff
+	}
+	limit := r.maxAuthBackoff
+	if limit < backoff {
+		limit = DefaultMaxAuthBackoff
+	}
+	for i := 0; i < r.authFailures && backoff < limit; i++ {
+		backoff *= 2
+	}
+	if backoff > limit {
+		backoff = limit
+	}
+
+	r.authFailures++
+	r.authBlockedUntil = time.Now().Add(backoff)
+	r.challenge = nil
+
+	return r.authBlockedUntil, true
+}
+
+// authSucceeded resets the backoff after the device accepted the credentials sent for the challenge.
+func (r *Root) authSucceeded(c *digestChallenge) {
+	r.authLock.Lock()
+	defer r.authLock.Unlock()
+
+	c.accepted = true
+	r.authFailures = 0
+	r.authBlockedUntil = time.Time{}
+}
@@ -0,0 +1,268 @@
+package fritzbox_upnp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/dekarl/fritzbox_exporter/fritzbox_upnp/internal/authparams"
+)
+
+func TestParseDigestChallenge(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   *digestChallenge // nil if an error is expected
+	}{
+		{
+			name:   "defaults",
+			header: `Digest realm="F!Box SOAP-Auth", nonce="ABC123"`,
+			want:   &digestChallenge{realm: "F!Box SOAP-Auth", nonce: "ABC123", algorithm: "MD5"},
+		},
+		{
+			name:   "all parameters",
+			header: `Digest realm="box", nonce="n", opaque="o", algorithm=SHA-256, qop="auth", stale=true`,
+			want:   &digestChallenge{realm: "box", nonce: "n", opaque: "o", algorithm: "SHA-256", qop: "auth", stale: true},
+		},
+		{
+			name:   "case insensitive",
+			header: `digest Realm="box", NONCE="n", algorithm=md5-SESS, stale=TRUE`,
+			want:   &digestChallenge{realm: "box", nonce: "n", algorithm: "MD5-sess", stale: true},
+		},
+		{
+			name:   "qop list",
+			header: `Digest realm="box", nonce="n", qop="auth-int, auth"`,
+			want:   &digestChallenge{realm: "box", nonce: "n", algorithm: "MD5", qop: "auth"},
+		},
+		{
+			name:   "quoted string",
+			header: `Digest realm="a, \"b\" \\ c", nonce="n"`,
+			want:   &digestChallenge{realm: `a, "b" \ c`, nonce: "n", algorithm: "MD5"},
+		},
+		{
+			name:   "tokens without spaces",
+			header: `Digest nonce=n,realm=box,algorithm=SHA-256-sess`,
+			want:   &digestChallenge{realm: "box", nonce: "n", algorithm: "SHA-256-sess"},
+		},
+		{name: "basic", header: `Basic realm="box"`},
+		{name: "no nonce", header: `Digest realm="box"`},
+		{name: "empty nonce", header: `Digest realm="box", nonce=""`},
+		{name: "unsupported algorithm", header: `Digest realm="box", nonce="n", algorithm=SHA-512-256`},
+		{name: "unsupported qop", header: `Digest realm="box", nonce="n", qop="auth-int"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := parseDigestChallenge(test.header)
+			if test.want == nil {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", c)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if c.cnonce == "" {
+				t.Error("no client nonce")
+			}
+			c.cnonce = ""
+			if *c != *test.want {
+				t.Errorf("got %+v, want %+v", *c, *test.want)
+			}
+		})
+	}
+}
+
+func TestParseDigestChallenges(t *testing.T) {
+	c, err := parseDigestChallenges([]string{
+		`Basic realm="box"`,
+		`Digest realm="box", nonce="1", algorithm=MD5`,
+		`Digest realm="box", nonce="2", algorithm=SHA-256`,
+		`Digest realm="box", nonce="3", algorithm=MD5-sess`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.algorithm != "SHA-256" || c.nonce != "2" {
+		t.Errorf("got algorithm %s with nonce %s, want the SHA-256 challenge", c.algorithm, c.nonce)
+	}
+
+	if _, err := parseDigestChallenges([]string{`Basic realm="box"`}); err == nil {
+		t.Error("expected an error without digest challenge")
+	}
+	if _, err := parseDigestChallenges(nil); err == nil {
+		t.Error("expected an error without header")
+	}
+}
+
+// challenge and credentials of the examples in RFC 7616, section 3.9.1
+func rfc7616Challenge(algorithm string, qop string) *digestChallenge {
+	return &digestChallenge{
+		realm:     "http-auth@example.org",
+		nonce:     "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v",
+		opaque:    "FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS",
+		algorithm: algorithm,
+		qop:       qop,
+		cnonce:    "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ",
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		qop       string
+		count     int // number of the request checked
+		response  string
+	}{
+		// RFC 7616, section 3.9.1
+		{"MD5", "auth", 1, "8ca523f5e9506fed4657c9700eebdbec"},
+		{"SHA-256", "auth", 1, "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+
+		{"MD5-sess", "auth", 1, "e783283f46242139c486a698fec7211d"},
+		{"SHA-256-sess", "auth", 1, "2fd51b3a77ad75bad6afad6003e818d767133c46d9e2749e7f5232ae1ea3efd7"},
+		{"MD5", "", 1, "7b2cc3b30e75b4777ea31027084363fd"},
+		{"SHA-256", "", 1, "a1306b0595a6c7fe96c448631fb5cfbd5107bd1fe1da729d978dd7446b812363"},
+		{"MD5", "auth", 2, "4b5d595ecf2db9df612ea5b45cd97101"},
+		{"SHA-256", "auth", 2, "8c8db27f49ff1c202f9fb49fa9d2e9eabf078dcc93db40dfd6527010091d1c8e"},
+	}
+
+	for _, test := range tests {
+		c := rfc7616Challenge(test.algorithm, test.qop)
+
+		var header string
+		for i := 0; i < test.count; i++ {
+			header = c.authorization("GET", "/dir/index.html", "Mufasa", "Circle of Life")
+		}
+
+		if !strings.HasPrefix(header, "Digest ") {
+			t.Fatalf("%s %q: header is not Digest: %s", test.algorithm, test.qop, header)
+		}
+		params := authparams.Parse(strings.TrimPrefix(header, "Digest "))
+
+		want := map[string]string{
+			"username":  "Mufasa",
+			"realm":     "http-auth@example.org",
+			"nonce":     "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v",
+			"uri":       "/dir/index.html",
+			"algorithm": test.algorithm,
+			"response":  test.response,
+			"opaque":    "FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS",
+		}
+		if test.qop != "" {
+			want["qop"] = test.qop
+			want["nc"] = fmt.Sprintf("%08x", test.count)
+			want["cnonce"] = "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ"
+		}
+
+		for name, value := range want {
+			if params[name] != value {
+				t.Errorf("%s %q request %d: %s is %q, want %q", test.algorithm, test.qop, test.count, name, params[name], value)
+			}
+		}
+		if len(params) != len(want) {
+			t.Errorf("%s %q request %d: unexpected parameters in %s", test.algorithm, test.qop, test.count, header)
+		}
+	}
+}
+
+func TestAuthFailed(t *testing.T) {
+	r := &Root{authBackoff: time.Second, maxAuthBackoff: 5 * time.Second}
+
+	for i, want := range []time.Duration{1, 2, 4, 5, 5} {
+		c := &digestChallenge{nonce: fmt.Sprint(i)}
+		r.challenge = c
+
+		start := time.Now()
+		until, counted := r.authFailed(c)
+		if !counted {
+			t.Fatalf("failure %d not counted", i+1)
+		}
+		if backoff := until.Sub(start); backoff < want*time.Second || backoff > want*time.Second+time.Second/2 {
+			t.Errorf("failure %d: backoff %s, want %s", i+1, backoff, want*time.Second)
+		}
+		if r.challenge != nil {
+			t.Errorf("failure %d: challenge not forgotten", i+1)
+		}
+
+		// a rejection with the same challenge is not counted again
+		if again, counted := r.authFailed(c); counted || !again.Equal(until) {
+			t.Errorf("failure %d counted twice", i+1)
+		}
+		if failures, blockedUntil := r.AuthState(); failures != i+1 || !blockedUntil.Equal(until) {
+			t.Errorf("failure %d: state is %d failures until %s", i+1, failures, blockedUntil)
+		}
+	}
+
+	c := &digestChallenge{nonce: "accepted"}
+	r.authSucceeded(c)
+	if failures, blockedUntil := r.AuthState(); failures != 0 || !blockedUntil.IsZero() {
+		t.Errorf("state not reset after success: %d failures until %s", failures, blockedUntil)
+	}
+	if !c.accepted {
+		t.Error("challenge not accepted after success")
+	}
+}
+
+func TestAuthFailedDefaults(t *testing.T) {
+	r := &Root{}
+	c := &digestChallenge{nonce: "n"}
+	r.challenge = c
+
+	start := time.Now()
+	until, _ := r.authFailed(c)
+	if backoff := until.Sub(start); backoff < DefaultAuthBackoff || backoff > DefaultAuthBackoff+time.Second {
+		t.Errorf("backoff %s, want %s", backoff, DefaultAuthBackoff)
+	}
+}
+
+func TestAuthorizeLogin(t *testing.T) {
+	r := &Root{Username: "user", Password: "password"}
+	c := &digestChallenge{realm: "box", nonce: "n", algorithm: "MD5", qop: "auth"}
+	r.challenge = c
+
+	request := func() *http.Request {
+		req, _ := http.NewRequest("POST", "http://fritz.box:49000/upnp/control/deviceinfo", nil)
+		return req
+	}
+
+	// only one call logs in with a new challenge
+	first := request()
+	if used, login := r.authorize(first); used != c || !login || first.Header.Get("Authorization") == "" {
+		t.Fatalf("first call not logging in: %v %v", used, login)
+	}
+	second := request()
+	if used, login := r.authorize(second); used != nil || login || second.Header.Get("Authorization") != "" {
+		t.Fatalf("second call logging in too: %v %v", used, login)
+	}
+
+	waited := make(chan error)
+	go func() {
+		waited <- r.waitLogin(context.Background())
+	}()
+	r.authSucceeded(c)
+	r.endLogin()
+	if err := <-waited; err != nil {
+		t.Fatal(err)
+	}
+
+	// all calls use an accepted challenge
+	for i := 0; i < 2; i++ {
+		req := request()
+		if used, login := r.authorize(req); used != c || login {
+			t.Errorf("call %d after login: %v %v", i, used, login)
+		}
+	}
+
+	// no credentials are sent during the backoff
+	r.authFailed(c)
+	r.challenge = c
+	req := request()
+	if used, _ := r.authorize(req); used != nil || req.Header.Get("Authorization") != "" {
+		t.Error("credentials sent during backoff")
+	}
+}
@@ -0,0 +1,98 @@
+package fritzbox_upnp
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var (
+	// ErrInvalidSOAPResponse is returned if the response of a call cannot be parsed.
+	ErrInvalidSOAPResponse = errors.New("invalid SOAP response")
+
+	// ErrUnauthorized matches errors of requests rejected because of wrong or missing credentials.
+	ErrUnauthorized = errors.New("unauthorized")
+
+	// ErrInvalidArgument matches SOAP faults caused by an invalid argument of a call, e.g. an index
+	// beyond the number of entries.
+	ErrInvalidArgument = errors.New("invalid argument")
+
+	// ErrArgumentMismatch is returned if the arguments of a call do not match the input arguments
+	// of the action or their data types. The action is not called.
+	ErrArgumentMismatch = errors.New("arguments do not match the action")
+
+	// ErrAuthBlocked is returned for calls requiring authentication while no credentials are sent,
+	// since the device rejected them recently. It is wrapped together with the HTTPStatusError.
+	ErrAuthBlocked = errors.New("authentication suspended after rejected login")
+
+	// ErrActionNotSupported matches SOAP faults of actions the device does not support,
+	// e.g. because of its firmware. A failed action (UPnP error 501) may succeed later and
+	// does not match.
+	ErrActionNotSupported = errors.New("action not supported")
+)
+
+// UPnP error codes
+const (
+	UpnpInvalidAction          = 401
+	UpnpInvalidArgs            = 402
+	UpnpActionFailed           = 501
+	UpnpArgumentValueInvalid   = 600
+	UpnpArgumentOutOfRange     = 601
+	UpnpOptionalNotImplemented = 602
+	UpnpArrayIndexInvalid      = 713
+	UpnpNoSuchArrayEntry       = 714
+)
+
+// An HTTPStatusError is returned if the device answers a request with an unexpected HTTP status.
+// It matches ErrUnauthorized for the status 401.
+type HTTPStatusError struct {
+	StatusCode int
+	Service    string // service type of the called action, empty for other requests
+	Action     string // name of the called action, empty for other requests
+	URL        string
+}
+
+func (e *HTTPStatusError) Error() string {
+	status := fmt.Sprintf("%s (%d)", http.StatusText(e.StatusCode), e.StatusCode)
+	if e.Action != "" {
+		return fmt.Sprintf("%s: %s", e.Action, status)
+	}
+	return fmt.Sprintf("%s: %s", e.URL, status)
+}
+
+func (e *HTTPStatusError) Is(target error) bool {
+	return target == ErrUnauthorized && e.StatusCode == http.StatusUnauthorized
+}
+
+// A SoapFaultError is returned if the device answers a call with a SOAP fault.
+// It matches ErrInvalidArgument and ErrActionNotSupported depending on the UPnP error code.
+type SoapFaultError struct {
+	FaultString string
+	Code        int    // UPnP error code, 0 if not given
+	Description string // UPnP error description
+	Service     string // service type of the called action
+	Action      string // name of the called action
+}
+
+func (e *SoapFaultError) Error() string {
+	if e.Code != 0 {
+		return fmt.Sprintf("%s: SOAPFault: %s %d (%s)", e.Action, e.FaultString, e.Code, e.Description)
+	}
+	return fmt.Sprintf("%s: SOAPFault: %s", e.Action, e.FaultString)
+}
+
+func (e *SoapFaultError) Is(target error) bool {
+	switch target {
+	case ErrInvalidArgument:
+		switch e.Code {
+		case UpnpInvalidArgs, UpnpArgumentValueInvalid, UpnpArgumentOutOfRange, UpnpArrayIndexInvalid, UpnpNoSuchArrayEntry:
+			return true
+		}
+	case ErrActionNotSupported:
+		switch e.Code {
+		case UpnpInvalidAction, UpnpOptionalNotImplemented:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+package fake
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/dekarl/fritzbox_exporter/fritzbox_upnp/internal/authparams"
+)
+
+// maximum number of nonces remembered, all nonces are forgotten when exceeded
+const maxNonces = 1000
+
+// state of a nonce handed out in a challenge
+type nonce struct {
+	issued time.Time
+	count  uint64 // highest nonce count used
+}
+
+// hashFunc returns the hash function of a digest algorithm or nil if the algorithm is not supported.
+func hashFunc(algorithm string) func() hash.Hash {
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "MD5":
+		return md5.New
+	case "SHA-256":
+		return sha256.New
+	}
+	return nil
+}
+
+func digest(h func() hash.Hash, parts ...string) string {
+	d := h()
+	d.Write([]byte(strings.Join(parts, ":")))
+	return hex.EncodeToString(d.Sum(nil))
+}
+
+// authenticate checks the digest authorization of the request. Returns false after answering
+// with a challenge, if the request is not authorized.
+func (s *Server) authenticate(w http.ResponseWriter, req *http.Request) bool {
+	sc := s.scenario
+	if sc.Username == "" {
+		return true
+	}
+
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Digest ") {
+		s.challenge(w, false)
+		return false
+	}
+	p := authparams.Parse(auth[len("Digest "):])
+
+	algorithm := p["algorithm"]
+	if algorithm == "" {
+		algorithm = "MD5"
+	}
+	if p["username"] != sc.Username || p["realm"] != sc.Realm || !strings.EqualFold(algorithm, sc.Algorithm) ||
+		p["qop"] != "auth" || p["uri"] != req.URL.RequestURI() {
+		s.challenge(w, false)
+		return false
+	}
+
+	count, err := strconv.ParseUint(p["nc"], 16, 64)
+	if err != nil {
+		s.challenge(w, false)
+		return false
+	}
+
+	h := hashFunc(sc.Algorithm)
+	ha1 := digest(h, sc.Username, sc.Realm, sc.Password)
+	if strings.HasSuffix(strings.ToUpper(sc.Algorithm), "-SESS") {
+		ha1 = digest(h, ha1, p["nonce"], p["cnonce"])
+	}
+	ha2 := digest(h, req.Method, p["uri"])
+	expected := digest(h, ha1, p["nonce"], p["nc"], p["cnonce"], p["qop"], ha2)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(p["response"])) != 1 {
+		s.challenge(w, false)
+		return false
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	n, ok := s.nonces[p["nonce"]]
+	if !ok {
+		s.challengeLocked(w, false)
+		return false
+	}
+	if sc.nonceLifetime > 0 && time.Since(n.issued) > sc.nonceLifetime {
+		// the credentials are right, the client only has to use a new nonce
+		delete(s.nonces, p["nonce"])
+		s.challengeLocked(w, true)
+		return false
+	}
+	if sc.CheckNonceCount && count <= n.count {
+		s.challengeLocked(w, false)
+		return false
+	}
+	n.count = count
+
+	return true
+}
+
+// challenge answers with a new nonce. Stale tells the client that only the nonce was outdated.
+func (s *Server) challenge(w http.ResponseWriter, stale bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.challengeLocked(w, stale)
+}
+
+func (s *Server) challengeLocked(w http.ResponseWriter, stale bool) {
+	if len(s.nonces) >= maxNonces {
+		s.nonces = make(map[string]*nonce)
+	}
+
+	value := fmt.Sprintf("%016X", s.random.Uint64())
+	s.nonces[value] = &nonce{issued: time.Now()}
+	s.challenges++
+
+	header := fmt.Sprintf(`Digest realm=%s, nonce="%s", algorithm=%s, qop="auth"`, authparams.Quote(s.scenario.Realm), value, s.scenario.Algorithm)
+	if stale {
+		header += ", stale=true"
+	}
+
+	w.Header().Set("WWW-Authenticate", header)
+	http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+}
@@ -0,0 +1,299 @@
+// Simulate the TR-064 and IGD interfaces of a FRITZ!Box for tests and demos.
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Scenario describes the simulated FRITZ!Box: its services, the results of their actions
+// and the failures to inject.
+type Scenario struct {
+	Username        string                         `json:"username"` // credentials required by TR-064 services, no authentication if empty
+	Password        string                         `json:"password"`
+	Realm           string                         `json:"realm"`           // realm of the digest challenge
+	Algorithm       string                         `json:"algorithm"`       // digest algorithm: MD5 (default), MD5-sess, SHA-256 or SHA-256-sess
+	NonceLifetime   string                         `json:"nonceLifetime"`   // nonces become stale after this duration, e.g. "5m"; never if empty
+	CheckNonceCount bool                           `json:"checkNonceCount"` // reject requests not increasing the nonce count
+	Latency         string                         `json:"latency"`         // delay of all answers to actions, e.g. "20ms"
+	Seed            int64                          `json:"seed"`            // seed of the random failures and nonces
+	Device          DeviceInfo                     `json:"device"`
+	Services        []*Service                     `json:"services"`
+	Lists           map[string][]map[string]string `json:"lists"` // entries of lists like the host list by path
+
+	nonceLifetime time.Duration
+	latency       time.Duration
+}
+
+// DeviceInfo is the information about the device in the descriptions.
+type DeviceInfo struct {
+	FriendlyName string `json:"friendlyName"`
+	Manufacturer string `json:"manufacturer"`
+	ModelName    string `json:"modelName"`
+	ModelNumber  string `json:"modelNumber"`
+	UDN          string `json:"udn"`
+}
+
+// A simulated service
+type Service struct {
+	ServiceType    string           `json:"serviceType"`
+	ServiceId      string           `json:"serviceId"`
+	TR64           bool             `json:"tr64"` // part of tr64desc.xml and requires authentication, otherwise part of igddesc.xml
+	StateVariables []*StateVariable `json:"stateVariables"`
+	Actions        []*Action        `json:"actions"`
+
+	name       string // name used in the URLs of the service
+	controlUrl string
+	scpdUrl    string
+}
+
+// A state variable of a service
+type StateVariable struct {
+	Name          string   `json:"name" xml:"name"`
+	DataType      string   `json:"dataType" xml:"dataType"`
+	AllowedValues []string `json:"allowedValues" xml:"allowedValueList>allowedValue,omitempty"`
+}
+
+// A simulated action. The action answers with the fault if given. Otherwise an action with
+// entries answers with the entry selected by its input arguments and all other actions answer
+// with the result. The only input argument is the index of the entry, with more input arguments
+// the entries contain their values.
+type Action struct {
+	Name          string              `json:"name"`
+	Arguments     []*Argument         `json:"arguments"`
+	Result        map[string]string   `json:"result"`        // values of the output arguments by name
+	Entries       []map[string]string `json:"entries"`       // values of the output arguments by index or input arguments
+	Fault         *Fault              `json:"fault"`         // UPnP error returned by each call
+	Latency       string              `json:"latency"`       // delay added to the latency of the scenario
+	FailureRate   float64             `json:"failureRate"`   // fraction of calls failing with the failure status
+	FailureStatus int                 `json:"failureStatus"` // HTTP status of failed calls, 503 if not given
+
+	latency time.Duration
+}
+
+// An argument of an action. The related state variable is the name without the prefix "New", if not given.
+type Argument struct {
+	Name                 string `json:"name" xml:"name"`
+	Direction            string `json:"direction" xml:"direction"`
+	RelatedStateVariable string `json:"relatedStateVariable" xml:"relatedStateVariable"`
+}
+
+// A Fault is an UPnP error returned by an action.
+type Fault struct {
+	Code        int    `json:"code"`
+	Description string `json:"description"`
+}
+
+// LoadScenario loads a scenario from a JSON file.
+func LoadScenario(file string) (*Scenario, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var scenario Scenario
+	err = json.Unmarshal(data, &scenario)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	return &scenario, nil
+}
+
+// init checks the scenario and fills in defaults.
+func (s *Scenario) init() error {
+	var err error
+
+	if s.Realm == "" {
+		s.Realm = "F!Box SOAP-Auth"
+	}
+	if s.Algorithm == "" {
+		s.Algorithm = "MD5"
+	}
+	if hashFunc(s.Algorithm) == nil {
+		return fmt.Errorf("unsupported digest algorithm %q", s.Algorithm)
+	}
+	if s.NonceLifetime != "" {
+		if s.nonceLifetime, err = time.ParseDuration(s.NonceLifetime); err != nil {
+			return fmt.Errorf("invalid nonce lifetime: %w", err)
+		}
+	}
+	if s.Latency != "" {
+		if s.latency, err = time.ParseDuration(s.Latency); err != nil {
+			return fmt.Errorf("invalid latency: %w", err)
+		}
+	}
+
+	if s.Device.FriendlyName == "" {
+		s.Device.FriendlyName = "FRITZ!Box 7590"
+	}
+	if s.Device.ModelName == "" {
+		s.Device.ModelName = s.Device.FriendlyName
+	}
+	if s.Device.Manufacturer == "" {
+		s.Device.Manufacturer = "AVM Berlin"
+	}
+
+	names := make(map[string]bool)
+	for _, svc := range s.Services {
+		err = svc.init()
+		if err != nil {
+			return fmt.Errorf("service %s: %w", svc.ServiceType, err)
+		}
+
+		if names[svc.controlUrl] {
+			return fmt.Errorf("service %s defined twice", svc.ServiceType)
+		}
+		names[svc.controlUrl] = true
+	}
+
+	return nil
+}
+
+func (svc *Service) init() error {
+	// e.g. urn:dslforum-org:service:WLANConfiguration:1
+	parts := strings.Split(svc.ServiceType, ":")
+	if len(parts) != 5 || parts[2] != "service" {
+		return fmt.Errorf("invalid service type")
+	}
+
+	svc.name = strings.ToLower(parts[3] + parts[4])
+	if svc.TR64 {
+		svc.controlUrl = "/upnp/control/" + svc.name
+		svc.scpdUrl = "/" + svc.name + "SCPD.xml"
+	} else {
+		svc.controlUrl = "/igdupnp/control/" + svc.name
+		svc.scpdUrl = "/igd" + svc.name + "SCPD.xml"
+	}
+	if svc.ServiceId == "" {
+		svc.ServiceId = "urn:" + parts[3] + "-com:serviceId:" + parts[3] + parts[4]
+	}
+
+	variables := make(map[string]bool)
+	for _, v := range svc.StateVariables {
+		variables[v.Name] = true
+	}
+
+	actions := make(map[string]bool)
+	for _, a := range svc.Actions {
+		if actions[a.Name] {
+			return fmt.Errorf("action %s defined twice", a.Name)
+		}
+		actions[a.Name] = true
+
+		err := a.init(variables)
+		if err != nil {
+			return fmt.Errorf("action %s: %w", a.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (a *Action) init(variables map[string]bool) error {
+	var err error
+	if a.Latency != "" {
+		if a.latency, err = time.ParseDuration(a.Latency); err != nil {
+			return fmt.Errorf("invalid latency: %w", err)
+		}
+	}
+	if a.FailureStatus == 0 {
+		a.FailureStatus = http.StatusServiceUnavailable
+	}
+	if a.Fault != nil && a.Fault.Code == 0 {
+		return fmt.Errorf("fault without code")
+	}
+
+	for _, arg := range a.Arguments {
+		if arg.Direction != "in" && arg.Direction != "out" {
+			return fmt.Errorf("argument %s: invalid direction %q", arg.Name, arg.Direction)
+		}
+		if arg.RelatedStateVariable == "" {
+			arg.RelatedStateVariable = strings.TrimPrefix(arg.Name, "New")
+		}
+		if !variables[arg.RelatedStateVariable] {
+			return fmt.Errorf("argument %s: unknown state variable %s", arg.Name, arg.RelatedStateVariable)
+		}
+	}
+
+	in := a.inArguments()
+	if len(a.Entries) > 0 && len(in) == 0 {
+		return fmt.Errorf("entries require an input argument")
+	}
+
+	for name := range a.Result {
+		if arg := a.argument(name); arg == nil || arg.Direction != "out" {
+			return fmt.Errorf("result %s is no output argument", name)
+		}
+	}
+	for i, entry := range a.Entries {
+		for name := range entry {
+			if arg := a.argument(name); arg == nil || arg.Direction == "in" && len(in) == 1 {
+				return fmt.Errorf("entry %d: %s is no output argument", i, name)
+			}
+		}
+		if len(in) == 1 {
+			continue
+		}
+		for _, arg := range in {
+			if _, ok := entry[arg.Name]; !ok {
+				return fmt.Errorf("entry %d: missing value of input argument %s", i, arg.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// entry returns the entry selected by the input arguments of a call, nil if there is none. Fails
+// for an index which is no number.
+func (a *Action) entry(args map[string]string) (map[string]string, error) {
+	in := a.inArguments()
+	if len(in) == 1 {
+		index, err := strconv.Atoi(args[in[0].Name])
+		if err != nil {
+			return nil, err
+		}
+		if index < 0 || index >= len(a.Entries) {
+			return nil, nil
+		}
+		return a.Entries[index], nil
+	}
+
+	for _, entry := range a.Entries {
+		match := true
+		for _, arg := range in {
+			if entry[arg.Name] != args[arg.Name] {
+				match = false
+			}
+		}
+		if match {
+			return entry, nil
+		}
+	}
+	return nil, nil
+}
+
+func (a *Action) argument(name string) *Argument {
+	for _, arg := range a.Arguments {
+		if arg.Name == name {
+			return arg
+		}
+	}
+	return nil
+}
+
+func (a *Action) inArguments() []*Argument {
+	var args []*Argument
+	for _, arg := range a.Arguments {
+		if arg.Direction == "in" {
+			args = append(args, arg)
+		}
+	}
+	return args
+}
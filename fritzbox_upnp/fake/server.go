@@ -0,0 +1,332 @@
+package fake
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const textXml = `text/xml; charset="utf-8"`
+
+// UPnP error codes returned by the simulator
+const (
+	upnpInvalidAction     = 401
+	upnpInvalidArgs       = 402
+	upnpArrayIndexInvalid = 713
+)
+
+// matches the arguments of a request, the FRITZ!Box does not require well-formed XML either
+var argumentPattern = regexp.MustCompile(`<([A-Za-z_][\w.-]*)>([^<]*)</`)
+
+// A Server simulates a FRITZ!Box as described by a scenario.
+type Server struct {
+	scenario *Scenario
+	docs     map[string][]byte   // descriptions and SCPDs by path
+	services map[string]*Service // services by control URL
+
+	lock       sync.Mutex // protects the fields below
+	random     *rand.Rand
+	nonces     map[string]*nonce
+	challenges int
+	calls      map[string]int // answered calls by service type and action
+}
+
+// xml documents served by the simulator
+type xmlRoot struct {
+	XMLName xml.Name  `xml:"root"`
+	Xmlns   string    `xml:"xmlns,attr"`
+	Device  xmlDevice `xml:"device"`
+}
+
+type xmlDevice struct {
+	DeviceType   string       `xml:"deviceType"`
+	FriendlyName string       `xml:"friendlyName"`
+	Manufacturer string       `xml:"manufacturer"`
+	ModelName    string       `xml:"modelName"`
+	ModelNumber  string       `xml:"modelNumber"`
+	UDN          string       `xml:"UDN"`
+	Services     []xmlService `xml:"serviceList>service"`
+}
+
+type xmlService struct {
+	ServiceType string `xml:"serviceType"`
+	ServiceId   string `xml:"serviceId"`
+	ControlUrl  string `xml:"controlURL"`
+	EventSubUrl string `xml:"eventSubURL"`
+	SCPDUrl     string `xml:"SCPDURL"`
+}
+
+type xmlSCPD struct {
+	XMLName        xml.Name         `xml:"scpd"`
+	Xmlns          string           `xml:"xmlns,attr"`
+	Actions        []xmlAction      `xml:"actionList>action"`
+	StateVariables []*StateVariable `xml:"serviceStateTable>stateVariable"`
+}
+
+type xmlAction struct {
+	Name      string      `xml:"name"`
+	Arguments []*Argument `xml:"argumentList>argument"`
+}
+
+// NewServer creates a server for the scenario. The scenario must not be changed afterwards.
+func NewServer(scenario *Scenario) (*Server, error) {
+	err := scenario.init()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		scenario: scenario,
+		docs:     make(map[string][]byte),
+		services: make(map[string]*Service),
+		random:   rand.New(rand.NewSource(scenario.Seed)),
+		nonces:   make(map[string]*nonce),
+		calls:    make(map[string]int),
+	}
+
+	igd := s.device("urn:schemas-upnp-org:device:InternetGatewayDevice:1")
+	tr64 := s.device("urn:dslforum-org:device:InternetGatewayDevice:1")
+	for _, svc := range scenario.Services {
+		desc := xmlService{
+			ServiceType: svc.ServiceType,
+			ServiceId:   svc.ServiceId,
+			ControlUrl:  svc.controlUrl,
+			EventSubUrl: "/upnp/event/" + svc.name,
+			SCPDUrl:     svc.scpdUrl,
+		}
+		scpd := xmlSCPD{Xmlns: "urn:schemas-upnp-org:service-1-0", StateVariables: svc.StateVariables}
+		if svc.TR64 {
+			tr64.Services = append(tr64.Services, desc)
+			scpd.Xmlns = "urn:dslforum-org:service-1-0"
+		} else {
+			igd.Services = append(igd.Services, desc)
+		}
+
+		for _, a := range svc.Actions {
+			scpd.Actions = append(scpd.Actions, xmlAction{Name: a.Name, Arguments: a.Arguments})
+		}
+
+		if s.docs[svc.scpdUrl], err = marshal(scpd); err != nil {
+			return nil, err
+		}
+		s.services[svc.controlUrl] = svc
+	}
+
+	if s.docs["/igddesc.xml"], err = marshal(xmlRoot{Xmlns: "urn:schemas-upnp-org:device-1-0", Device: igd}); err != nil {
+		return nil, err
+	}
+	if s.docs["/tr64desc.xml"], err = marshal(xmlRoot{Xmlns: "urn:dslforum-org:device-1-0", Device: tr64}); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Server) device(deviceType string) xmlDevice {
+	info := s.scenario.Device
+	return xmlDevice{
+		DeviceType:   deviceType,
+		FriendlyName: info.FriendlyName,
+		Manufacturer: info.Manufacturer,
+		ModelName:    info.ModelName,
+		ModelNumber:  info.ModelNumber,
+		UDN:          info.UDN,
+	}
+}
+
+func marshal(doc interface{}) ([]byte, error) {
+	data, err := xml.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+// Start starts a test server for the simulator. The caller has to close the test server.
+func (s *Server) Start() *httptest.Server {
+	return httptest.NewServer(s)
+}
+
+// StartTLS starts a test server for the simulator using TLS with a self signed certificate like the FRITZ!Box.
+func (s *Server) StartTLS() *httptest.Server {
+	return httptest.NewTLSServer(s)
+}
+
+// Calls returns the number of answered calls of the action of the service, including failed calls.
+func (s *Server) Calls(serviceType string, action string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.calls[serviceType+"#"+action]
+}
+
+// Challenges returns the number of digest challenges sent.
+func (s *Server) Challenges() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.challenges
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		if doc, ok := s.docs[req.URL.Path]; ok {
+			w.Header().Set("Content-Type", textXml)
+			w.Write(doc)
+			return
+		}
+		if items, ok := s.scenario.Lists[req.URL.Path]; ok {
+			w.Header().Set("Content-Type", textXml)
+			w.Write(listXml(items))
+			return
+		}
+		http.NotFound(w, req)
+	case http.MethodPost:
+		svc, ok := s.services[req.URL.Path]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		s.serveAction(w, req, svc)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveAction answers a SOAP request for an action of the service.
+func (s *Server) serveAction(w http.ResponseWriter, req *http.Request, svc *Service) {
+	if svc.TR64 && !s.authenticate(w, req) {
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// e.g. urn:dslforum-org:service:DeviceInfo:1#GetInfo
+	soapAction := strings.Trim(req.Header.Get("SOAPAction"), `"`)
+	serviceType, name := "", soapAction
+	if i := strings.LastIndex(soapAction, "#"); i >= 0 {
+		serviceType, name = soapAction[:i], soapAction[i+1:]
+	}
+
+	var action *Action
+	for _, a := range svc.Actions {
+		if a.Name == name {
+			action = a
+		}
+	}
+	if action == nil || serviceType != svc.ServiceType {
+		writeFault(w, upnpInvalidAction, "Invalid Action")
+		return
+	}
+
+	s.lock.Lock()
+	s.calls[svc.ServiceType+"#"+action.Name]++
+	failed := action.FailureRate > 0 && s.random.Float64() < action.FailureRate
+	s.lock.Unlock()
+
+	select {
+	case <-time.After(s.scenario.latency + action.latency):
+	case <-req.Context().Done():
+		return
+	}
+
+	if failed {
+		http.Error(w, http.StatusText(action.FailureStatus), action.FailureStatus)
+		return
+	}
+	if action.Fault != nil {
+		writeFault(w, action.Fault.Code, action.Fault.Description)
+		return
+	}
+
+	args := make(map[string]string)
+	for _, m := range argumentPattern.FindAllStringSubmatch(string(body), -1) {
+		args[m[1]] = html.UnescapeString(m[2])
+	}
+	for _, arg := range action.inArguments() {
+		if _, ok := args[arg.Name]; !ok {
+			writeFault(w, upnpInvalidArgs, "Invalid Args")
+			return
+		}
+	}
+
+	result := action.Result
+	if len(action.Entries) > 0 {
+		entry, err := action.entry(args)
+		if err != nil {
+			writeFault(w, upnpInvalidArgs, "Invalid Args")
+			return
+		}
+		if entry == nil {
+			writeFault(w, upnpArrayIndexInvalid, "SpecifiedArrayIndexInvalid")
+			return
+		}
+		result = entry
+	}
+
+	var out bytes.Buffer
+	for _, arg := range action.Arguments {
+		value, ok := result[arg.Name]
+		if arg.Direction != "out" || !ok {
+			continue
+		}
+		out.WriteString("<" + arg.Name + ">")
+		xml.EscapeText(&out, []byte(value))
+		out.WriteString("</" + arg.Name + ">")
+	}
+
+	w.Header().Set("Content-Type", textXml)
+	fmt.Fprintf(w, `%s<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">`+
+		`<s:Body><u:%sResponse xmlns:u="%s">%s</u:%sResponse></s:Body></s:Envelope>`,
+		xml.Header, action.Name, svc.ServiceType, out.String(), action.Name)
+}
+
+// writeFault answers with an UPnP error.
+func writeFault(w http.ResponseWriter, code int, description string) {
+	var desc bytes.Buffer
+	xml.EscapeText(&desc, []byte(description))
+
+	w.Header().Set("Content-Type", textXml)
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `%s<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">`+
+		`<s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>`+
+		`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError>`+
+		`</detail></s:Fault></s:Body></s:Envelope>`, xml.Header, code, desc.String())
+}
+
+// listXml returns a list like the host list with an Item element per entry.
+func listXml(items []map[string]string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header + "<List>")
+	for _, item := range items {
+		var names []string
+		for name := range item {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		buf.WriteString("<Item>")
+		for _, name := range names {
+			buf.WriteString("<" + name + ">")
+			xml.EscapeText(&buf, []byte(item[name]))
+			buf.WriteString("</" + name + ">")
+		}
+		buf.WriteString("</Item>")
+	}
+	buf.WriteString("</List>")
+	return buf.Bytes()
+}
@@ -0,0 +1,291 @@
+package fake_test
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	upnp "gitlab.com/dekarl/fritzbox_exporter/fritzbox_upnp"
+	"gitlab.com/dekarl/fritzbox_exporter/fritzbox_upnp/fake"
+)
+
+const (
+	deviceInfo = "urn:dslforum-org:service:DeviceInfo:1"
+	wanCommon  = "urn:schemas-upnp-org:service:WANCommonInterfaceConfig:1"
+	hosts      = "urn:dslforum-org:service:Hosts:1"
+)
+
+// start starts the simulator with the example scenario, changed by modify if not nil.
+func start(t *testing.T, modify func(sc *fake.Scenario)) (*fake.Server, *httptest.Server) {
+	t.Helper()
+
+	sc, err := fake.LoadScenario("scenario.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.Latency = ""
+	if modify != nil {
+		modify(sc)
+	}
+
+	s, err := fake.NewServer(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := s.Start()
+	t.Cleanup(ts.Close)
+
+	return s, ts
+}
+
+// action returns the action of the service or fails the test.
+func action(t *testing.T, root *upnp.Root, serviceType string, name string) *upnp.Action {
+	t.Helper()
+
+	svc, ok := root.Services[serviceType]
+	if !ok {
+		t.Fatalf("service %s not loaded", serviceType)
+	}
+	a, ok := svc.Actions[name]
+	if !ok {
+		t.Fatalf("action %s of %s not loaded", name, serviceType)
+	}
+	return a
+}
+
+// findAction returns the action of the scenario.
+func findAction(sc *fake.Scenario, serviceType string, name string) *fake.Action {
+	for _, svc := range sc.Services {
+		if svc.ServiceType != serviceType {
+			continue
+		}
+		for _, a := range svc.Actions {
+			if a.Name == name {
+				return a
+			}
+		}
+	}
+	return nil
+}
+
+func TestCall(t *testing.T) {
+	s, ts := start(t, nil)
+
+	root, err := upnp.LoadServices(ts.URL, "admin", "secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// IGD service without authentication
+	result, err := action(t, root, wanCommon, "GetTotalBytesSent").Call()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result["TotalBytesSent"] != uint64(1538445867) {
+		t.Errorf("TotalBytesSent is %v", result["TotalBytesSent"])
+	}
+
+	// TR-064 service with digest authentication, the challenge is reused
+	for i := 0; i < 3; i++ {
+		result, err = action(t, root, deviceInfo, "GetInfo").Call()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result["ModelName"] != "FRITZ!Box 7590" || result["UpTime"] != uint64(1814400) {
+			t.Errorf("unexpected result %v", result)
+		}
+	}
+	if n := s.Challenges(); n != 1 {
+		t.Errorf("%d challenges, want 1", n)
+	}
+
+	// indexed action
+	result, err = action(t, root, hosts, "GetGenericHostEntry").Call(&upnp.ActionArgument{Name: "NewIndex", Value: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result["HostName"] == "" {
+		t.Errorf("no host name in %v", result)
+	}
+
+	if failures, _ := root.AuthState(); failures != 0 {
+		t.Errorf("%d authentication failures", failures)
+	}
+}
+
+func TestWrongPassword(t *testing.T) {
+	s, ts := start(t, nil)
+
+	root, err := upnp.LoadServices(ts.URL, "admin", "wrong", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getInfo := action(t, root, deviceInfo, "GetInfo")
+
+	_, err = getInfo.Call()
+	var statusErr *upnp.HTTPStatusError
+	if !errors.As(err, &statusErr) || !errors.Is(err, upnp.ErrUnauthorized) {
+		t.Fatalf("got error %v, want unauthorized", err)
+	}
+	failures, blockedUntil := root.AuthState()
+	if failures != 1 || !blockedUntil.After(time.Now()) {
+		t.Errorf("state is %d failures until %s", failures, blockedUntil)
+	}
+
+	// no credentials are sent during the backoff
+	challenges := s.Challenges()
+	_, err = getInfo.Call()
+	if !errors.Is(err, upnp.ErrAuthBlocked) {
+		t.Errorf("got error %v, want blocked", err)
+	}
+	if failures, _ := root.AuthState(); failures != 1 {
+		t.Errorf("%d failures after blocked call", failures)
+	}
+	if n := s.Challenges() - challenges; n != 1 {
+		t.Errorf("%d challenges during backoff, want 1", n)
+	}
+
+	// services without authentication still work
+	if _, err := action(t, root, wanCommon, "GetTotalBytesSent").Call(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStaleNonce(t *testing.T) {
+	s, ts := start(t, func(sc *fake.Scenario) {
+		sc.NonceLifetime = "50ms"
+	})
+
+	root, err := upnp.LoadServices(ts.URL, "admin", "secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getInfo := action(t, root, deviceInfo, "GetInfo")
+
+	if _, err := getInfo.Call(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := getInfo.Call(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := s.Challenges(); n != 2 {
+		t.Errorf("%d challenges, want 2", n)
+	}
+	if failures, _ := root.AuthState(); failures != 0 {
+		t.Errorf("%d authentication failures", failures)
+	}
+	if n := s.Calls(deviceInfo, "GetInfo"); n != 2 {
+		t.Errorf("%d calls answered, want 2", n)
+	}
+}
+
+func TestConcurrentNonceCount(t *testing.T) {
+	_, ts := start(t, func(sc *fake.Scenario) {
+		sc.CheckNonceCount = true
+		sc.Latency = "5ms"
+	})
+
+	root, err := upnp.LoadServices(ts.URL, "admin", "secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getInfo := action(t, root, deviceInfo, "GetInfo")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8*10)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if _, err := getInfo.Call(); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if failures, _ := root.AuthState(); failures != 0 {
+		t.Errorf("%d authentication failures", failures)
+	}
+}
+
+func TestSoapFault(t *testing.T) {
+	_, ts := start(t, func(sc *fake.Scenario) {
+		findAction(sc, deviceInfo, "GetInfo").Fault = &fake.Fault{Code: upnp.UpnpActionFailed, Description: "Action Failed"}
+	})
+
+	root, err := upnp.LoadServices(ts.URL, "admin", "secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = action(t, root, deviceInfo, "GetInfo").Call()
+	var fault *upnp.SoapFaultError
+	if !errors.As(err, &fault) {
+		t.Fatalf("got error %v, want SOAP fault", err)
+	}
+	if fault.Code != upnp.UpnpActionFailed || fault.Description != "Action Failed" || fault.Action != "GetInfo" {
+		t.Errorf("unexpected fault %+v", fault)
+	}
+	if errors.Is(err, upnp.ErrActionNotSupported) {
+		t.Error("failed action is not supported")
+	}
+
+	// an index out of range is an invalid argument
+	_, err = action(t, root, hosts, "GetGenericHostEntry").Call(&upnp.ActionArgument{Name: "NewIndex", Value: 1000})
+	if !errors.Is(err, upnp.ErrInvalidArgument) {
+		t.Errorf("got error %v, want invalid argument", err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	_, ts := start(t, func(sc *fake.Scenario) {
+		findAction(sc, deviceInfo, "GetInfo").Latency = "1s"
+	})
+
+	root, err := upnp.LoadServicesContext(context.Background(), ts.URL, "admin", "secret", false, upnp.WithTimeout(2*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = action(t, root, deviceInfo, "GetInfo").CallContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want deadline exceeded", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("call aborted after %s", d)
+	}
+}
+
+func TestRootWithoutNewRoot(t *testing.T) {
+	_, ts := start(t, nil)
+
+	// a root not created by NewRoot uses the defaults
+	root := &upnp.Root{BaseUrl: ts.URL, Username: "admin", Password: "secret"}
+	if err := root.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := action(t, root, deviceInfo, "GetInfo").Call()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result["UpTime"] != uint64(1814400) {
+		t.Errorf("UpTime is %v", result["UpTime"])
+	}
+}
@@ -0,0 +1,47 @@
+package fritzbox_upnp
+
+import (
+	"errors"
+	"time"
+)
+
+// Hooks are notified about the calls of actions, e.g. to instrument them. The methods are called
+// concurrently if actions are called concurrently. Implementations should embed NopHooks to stay
+// compatible when methods are added.
+type Hooks interface {
+	// CallDone is called after each call of an action with its duration, including retries.
+	CallDone(service string, action string, duration time.Duration, err error)
+
+	// Retried is called whenever the request of a call is sent again.
+	Retried(service string, action string)
+
+	// Reauthenticated is called whenever a new digest authentication is computed for a call.
+	Reauthenticated(service string, action string)
+
+	// AuthFailed is called whenever the device rejects the credentials. No credentials are sent
+	// until blockedUntil.
+	AuthFailed(service string, action string, blockedUntil time.Time)
+}
+
+// NopHooks ignores all notifications.
+type NopHooks struct{}
+
+func (NopHooks) CallDone(service string, action string, duration time.Duration, err error) {}
+
+func (NopHooks) Retried(service string, action string) {}
+
+func (NopHooks) Reauthenticated(service string, action string) {}
+
+func (NopHooks) AuthFailed(service string, action string, blockedUntil time.Time) {}
+
+// WithHooks notifies the hooks about all calls of actions.
+func WithHooks(hooks Hooks) Option {
+	return func(c *clientConfig) error {
+		if hooks == nil {
+			return errors.New("hooks must not be nil")
+		}
+
+		c.hooks = hooks
+		return nil
+	}
+}
@@ -0,0 +1,47 @@
+// Package authparams parses and quotes the parameters of HTTP authentication headers.
+package authparams
+
+import "strings"
+
+// Parse parses the comma separated parameters of an authentication header. Names are converted
+// to lower case. Values are tokens or quoted strings, which may contain commas and escaped
+// characters.
+func Parse(s string) map[string]string {
+	params := make(map[string]string)
+
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			return params
+		}
+		name := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " \t")
+
+		var value strings.Builder
+		if strings.HasPrefix(s, `"`) {
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				value.WriteByte(s[i])
+			}
+			s = s[min(i+1, len(s)):]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			value.WriteString(strings.TrimSpace(s[:end]))
+			s = s[end:]
+		}
+
+		params[name] = value.String()
+	}
+}
+
+// Quote returns s as quoted string.
+func Quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
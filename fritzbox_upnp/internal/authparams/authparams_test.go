@@ -0,0 +1,35 @@
+package authparams
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		header string
+		want   map[string]string
+	}{
+		{``, map[string]string{}},
+		{`realm="box", nonce=abc`, map[string]string{"realm": "box", "nonce": "abc"}},
+		{`Realm = "box" ,NONCE=abc,,qop="auth,auth-int"`, map[string]string{"realm": "box", "nonce": "abc", "qop": "auth,auth-int"}},
+		{`realm="a \"b\" \\ c", stale=true`, map[string]string{"realm": `a "b" \ c`, "stale": "true"}},
+		{`realm="unterminated`, map[string]string{"realm": "unterminated"}},
+		{`realm=""`, map[string]string{"realm": ""}},
+		{`no parameters`, map[string]string{}},
+	}
+
+	for _, test := range tests {
+		if got := Parse(test.header); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Parse(%q) = %v, want %v", test.header, got, test.want)
+		}
+	}
+}
+
+func TestQuote(t *testing.T) {
+	for _, s := range []string{"", "box", `a "b" \ c`, "a, b"} {
+		if got := Parse("v=" + Quote(s))["v"]; got != s {
+			t.Errorf("quoted %q parsed as %q", s, got)
+		}
+	}
+}
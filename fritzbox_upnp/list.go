@@ -0,0 +1,88 @@
+package fritzbox_upnp
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// GetList downloads and parses a list returned as path by an action like X_AVM-DE_GetHostListPath.
+// The list is an XML document with an Item element per entry. Each entry is returned as Result
+// indexed by the names of the child elements of the Item. Values which are unsigned integers are
+// returned as uint64, all other values as string.
+func (r *Root) GetList(path string) ([]Result, error) {
+	return r.GetListContext(context.Background(), path)
+}
+
+// GetListContext downloads and parses a list like GetList. The download is aborted when the context is done.
+func (r *Root) GetListContext(ctx context.Context, path string) ([]Result, error) {
+	url := path
+	if !strings.Contains(path, "://") {
+		url = r.BaseUrl + path
+	}
+
+	resp, err := r.get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &HTTPStatusError{StatusCode: resp.StatusCode, URL: url}
+	}
+
+	return parseList(resp.Body)
+}
+
+func parseList(r io.Reader) ([]Result, error) {
+	var list []Result
+	var item Result
+	var field string
+	var value strings.Builder
+
+	dec := xml.NewDecoder(r)
+
+	for {
+		t, err := dec.Token()
+		if err == io.EOF {
+			return list, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		switch element := t.(type) {
+		case xml.StartElement:
+			if element.Name.Local == "Item" {
+				item = make(Result)
+			} else if item != nil {
+				field = element.Name.Local
+				value.Reset()
+			}
+		case xml.CharData:
+			if field != "" {
+				value.Write(element)
+			}
+		case xml.EndElement:
+			if element.Name.Local == "Item" && item != nil {
+				list = append(list, item)
+				item = nil
+			} else if field != "" {
+				item[field] = convertListValue(value.String())
+				field = ""
+			}
+		}
+	}
+}
+
+func convertListValue(val string) interface{} {
+	if res, err := strconv.ParseUint(val, 10, 64); err == nil {
+		return res
+	}
+	return val
+}
@@ -0,0 +1,104 @@
+package fritzbox_upnp
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseList(t *testing.T) {
+	tests := []struct {
+		file    string
+		want    []Result
+		wantErr bool
+	}{
+		{
+			file: "hostlist.xml",
+			want: []Result{
+				{
+					"Index":          uint64(1),
+					"IPAddress":      "192.168.178.20",
+					"MACAddress":     "3C:A6:2F:00:00:01",
+					"Active":         uint64(1),
+					"HostName":       "Tom & Jerry's laptop",
+					"InterfaceType":  "802.11",
+					"X_AVM-DE_Port":  uint64(0),
+					"X_AVM-DE_Speed": uint64(866),
+					"X_AVM-DE_Guest": "",
+				},
+				{
+					"Index":          uint64(2),
+					"IPAddress":      "192.168.178.21",
+					"MACAddress":     "3C:A6:2F:00:00:02",
+					"Active":         uint64(0),
+					"HostName":       "nas",
+					"InterfaceType":  "Ethernet",
+					"X_AVM-DE_Port":  uint64(2),
+					"X_AVM-DE_Speed": uint64(1000),
+					"X_AVM-DE_Guest": uint64(0),
+				},
+			},
+		},
+		{
+			file: "hostlist_empty.xml",
+			want: nil,
+		},
+		{
+			// values which are no unsigned integers are kept as they are
+			file: "hostlist_bad_value.xml",
+			want: []Result{
+				{
+					"Index":          "18446744073709551616",
+					"Active":         "yes",
+					"HostName":       "phone",
+					"X_AVM-DE_Speed": "-1",
+					"X_AVM-DE_Port":  " 3",
+				},
+			},
+		},
+		{
+			file:    "hostlist_truncated.xml",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			got, err := parseList(f)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseList() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseList() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertListValue(t *testing.T) {
+	tests := []struct {
+		val  string
+		want interface{}
+	}{
+		{"0", uint64(0)},
+		{"18446744073709551615", uint64(18446744073709551615)},
+		{"18446744073709551616", "18446744073709551616"},
+		{"-1", "-1"},
+		{"1.5", "1.5"},
+		{"", ""},
+		{"laptop", "laptop"},
+	}
+
+	for _, tt := range tests {
+		if got := convertListValue(tt.val); got != tt.want {
+			t.Errorf("convertListValue(%q) = %v (%T), want %v (%T)", tt.val, got, got, tt.want, tt.want)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package fritzbox_upnp
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// A Middleware wraps the transport used for all requests to the device, e.g. to log, trace,
+// limit or record the requests.
+type Middleware func(next http.RoundTripper) http.RoundTripper
+
+// RoundTripperFunc is a function implementing http.RoundTripper.
+type RoundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f RoundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// WithMiddleware wraps the transport of the HTTP client into the middlewares. The first
+// middleware sees the requests first. Can be given multiple times to add further middlewares.
+func WithMiddleware(middlewares ...Middleware) Option {
+	return func(c *clientConfig) error {
+		for _, m := range middlewares {
+			if m == nil {
+				return errors.New("middleware must not be nil")
+			}
+		}
+
+		c.middlewares = append(c.middlewares, middlewares...)
+		return nil
+	}
+}
+
+// wrap the transport into the middlewares
+func wrapTransport(transport http.RoundTripper, middlewares []Middleware) http.RoundTripper {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		transport = middlewares[i](transport)
+	}
+	return transport
+}
+
+// headers whose values are never logged
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// query parameters whose values are never logged, the FRITZ!Box passes session ids as sid
+var sensitiveParams = []string{"sid"}
+
+const redacted = "REDACTED"
+
+// LoggingMiddleware logs each request and its response at debug level. Credentials in headers
+// and session ids in URLs are redacted.
+func LoggingMiddleware(logger *slog.Logger) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			start := time.Now()
+			resp, err := next.RoundTrip(req)
+
+			args := []interface{}{
+				"method", req.Method,
+				"url", redactURL(req.URL),
+				"headers", redactHeader(req.Header),
+				"duration", time.Since(start),
+			}
+			if err != nil {
+				logger.Debug("request failed", append(args, "err", err)...)
+				return nil, err
+			}
+
+			logger.Debug("request done", append(args, "status", resp.StatusCode)...)
+			return resp, nil
+		})
+	}
+}
+
+// redactHeader returns a copy of the header without credentials.
+func redactHeader(header http.Header) http.Header {
+	copied := header.Clone()
+	for _, name := range sensitiveHeaders {
+		if copied.Get(name) != "" {
+			copied.Set(name, redacted)
+		}
+	}
+	return copied
+}
+
+// redactURL returns the URL without passwords and session ids.
+func redactURL(u *url.URL) string {
+	copied := *u
+	if _, ok := copied.User.Password(); ok {
+		copied.User = url.UserPassword(copied.User.Username(), redacted)
+	}
+
+	query := copied.Query()
+	changed := false
+	for _, param := range sensitiveParams {
+		if query.Get(param) != "" {
+			query.Set(param, redacted)
+			changed = true
+		}
+	}
+	if changed {
+		copied.RawQuery = query.Encode()
+	}
+
+	return copied.String()
+}
+
+// RateLimitMiddleware limits the requests to the device to rate per second on average, allowing
+// bursts of up to burst requests. Requests wait for their turn until their context is done.
+func RateLimitMiddleware(rate float64, burst int) Middleware {
+	if burst < 1 {
+		burst = 1
+	}
+	bucket := newTokenBucket(rate, burst, time.Now)
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if err := bucket.wait(req); err != nil {
+				return nil, err
+			}
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// tokenBucket holds up to burst tokens and is refilled with rate tokens per second.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+	now   func() time.Time // clock of the bucket, replaced by tests
+
+	sync.Mutex // protects tokens and updated
+	tokens     float64
+	updated    time.Time
+}
+
+// newTokenBucket creates a full bucket using the given clock.
+func newTokenBucket(rate float64, burst int, now func() time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), now: now, tokens: float64(burst), updated: now()}
+}
+
+// wait takes a token, waiting until one is available or the context of the request is done.
+func (b *tokenBucket) wait(req *http.Request) error {
+	if b.rate <= 0 {
+		return nil
+	}
+
+	delay := b.reserve(b.now())
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-req.Context().Done():
+		// the reserved token is lost, which only delays later requests slightly
+		return req.Context().Err()
+	}
+}
+
+// reserve takes a token and returns the time to wait until it is available.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+
+	b.tokens += now.Sub(b.updated).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.updated = now
+
+	// tokens may become negative, reserving them for the waiting requests
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
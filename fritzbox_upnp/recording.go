@@ -0,0 +1,272 @@
+package fritzbox_upnp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ErrNotRecorded is returned when replaying a request that was not recorded.
+var ErrNotRecorded = errors.New("request not recorded")
+
+// DefaultRedactedElements are the elements of requests and responses whose values are redacted by default.
+var DefaultRedactedElements = []string{
+	"NewSerialNumber",
+	"NewPassword",
+	"NewKeyPassphrase",
+	"NewPreSharedKey",
+	"NewX_AVM-DE_Password",
+}
+
+// matches session ids in URLs like the path of the host list
+var sessionIdPattern = regexp.MustCompile(`([?&]sid=)[^&<"]*`)
+
+// An exchange is a recorded request and its response.
+type exchange struct {
+	Method      string            `json:"method"`
+	URL         string            `json:"url"` // path and query with redacted session ids
+	SoapAction  string            `json:"soapAction,omitempty"`
+	Request     string            `json:"request,omitempty"`
+	RequestHash string            `json:"requestHash"` // hash of the request before redacting
+	StatusCode  int               `json:"statusCode"`
+	Header      map[string]string `json:"header,omitempty"`
+	Response    string            `json:"response"`
+}
+
+// response headers kept in recordings, the digest challenge is needed to authenticate when replaying
+var recordedHeaders = []string{"Content-Type", "WWW-Authenticate"}
+
+// key identifies the exchange for a request. Session ids are ignored, since they change with
+// each login and are redacted in recordings.
+func exchangeKey(method string, u *url.URL, soapAction string, bodyHash string) string {
+	path := sessionIdPattern.ReplaceAllString(u.RequestURI(), "")
+	return method + " " + path + " " + soapAction + " " + bodyHash
+}
+
+// hash of a request body, which identifies the arguments of a call
+func bodyHash(body string) string {
+	hash := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(hash[:8])
+}
+
+// file name for the exchange, readable and unique per key
+func exchangeFile(key string, u *url.URL, soapAction string) string {
+	name := strings.Trim(u.Path, "/")
+	if soapAction != "" {
+		name += "-" + soapAction[strings.LastIndex(soapAction, "#")+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, name)
+
+	hash := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("%s-%s.json", name, hex.EncodeToString(hash[:4]))
+}
+
+// readBody returns the body of the request and leaves the request readable.
+func readBody(req *http.Request) (string, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return "", nil
+	}
+
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return "", err
+		}
+		defer body.Close()
+
+		data, err := ioutil.ReadAll(body)
+		return string(data), err
+	}
+
+	data, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+	return string(data), nil
+}
+
+// A redactor replaces sensitive values in recorded requests and responses.
+type redactor struct {
+	elements *regexp.Regexp
+}
+
+// newRedactor redacts the values of the given XML elements. Session ids are always redacted.
+func newRedactor(elements []string) *redactor {
+	r := &redactor{}
+
+	if len(elements) > 0 {
+		quoted := make([]string, len(elements))
+		for i, e := range elements {
+			quoted[i] = regexp.QuoteMeta(e)
+		}
+		r.elements = regexp.MustCompile(`<((?:` + strings.Join(quoted, "|") + `))>[^<]*</`)
+	}
+
+	return r
+}
+
+func (r *redactor) redact(s string) string {
+	if r.elements != nil {
+		s = r.elements.ReplaceAllString(s, "<${1}>"+redacted+"</")
+	}
+	return sessionIdPattern.ReplaceAllString(s, "${1}"+redacted)
+}
+
+// RecordMiddleware stores each request and its response as JSON file in dir. Credentials in headers
+// are never stored, the values of the given XML elements and session ids are redacted. The
+// recordings can be served by ReplayMiddleware.
+func RecordMiddleware(dir string, redactElements []string) (Middleware, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	redactor := newRedactor(redactElements)
+	var lock sync.Mutex
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			reqBody, err := readBody(req)
+			if err != nil {
+				return nil, err
+			}
+
+			resp, err := next.RoundTrip(req)
+			if err != nil {
+				return nil, err
+			}
+
+			respBody, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+
+			soapAction := req.Header.Get("SoapAction")
+			hash := bodyHash(reqBody)
+			key := exchangeKey(req.Method, req.URL, soapAction, hash)
+
+			ex := &exchange{
+				Method:      req.Method,
+				URL:         sessionIdPattern.ReplaceAllString(req.URL.RequestURI(), "${1}"+redacted),
+				SoapAction:  soapAction,
+				Request:     redactor.redact(reqBody),
+				RequestHash: hash,
+				StatusCode:  resp.StatusCode,
+				Header:      make(map[string]string),
+				Response:    redactor.redact(string(respBody)),
+			}
+			header := redactHeader(resp.Header)
+			for _, name := range recordedHeaders {
+				if v := header.Get(name); v != "" {
+					ex.Header[name] = v
+				}
+			}
+
+			// keep the XML readable
+			var data bytes.Buffer
+			enc := json.NewEncoder(&data)
+			enc.SetEscapeHTML(false)
+			enc.SetIndent("", "  ")
+			err = enc.Encode(ex)
+			if err != nil {
+				return nil, err
+			}
+
+			// the last exchange wins, e.g. the authenticated call after the digest challenge
+			lock.Lock()
+			err = ioutil.WriteFile(filepath.Join(dir, exchangeFile(key, req.URL, soapAction)), data.Bytes(), 0644)
+			lock.Unlock()
+			if err != nil {
+				return nil, fmt.Errorf("cannot record %s: %s", req.URL.Path, err)
+			}
+
+			return resp, nil
+		})
+	}, nil
+}
+
+// ReplayMiddleware answers all requests with the exchanges recorded by RecordMiddleware in dir.
+// No request is passed to the next transport. Requests not recorded fail with ErrNotRecorded.
+func ReplayMiddleware(dir string) (Middleware, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no recordings found in %s", dir)
+	}
+
+	exchanges := make(map[string]*exchange)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		ex := &exchange{}
+		err = json.Unmarshal(data, ex)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+
+		u, err := url.Parse(ex.URL)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+
+		exchanges[exchangeKey(ex.Method, u, ex.SoapAction, ex.RequestHash)] = ex
+	}
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			reqBody, err := readBody(req)
+			if err != nil {
+				return nil, err
+			}
+
+			soapAction := req.Header.Get("SoapAction")
+			ex, ok := exchanges[exchangeKey(req.Method, req.URL, soapAction, bodyHash(reqBody))]
+			if !ok {
+				return nil, fmt.Errorf("%w: %s %s %s", ErrNotRecorded, req.Method, req.URL.Path, soapAction)
+			}
+
+			header := make(http.Header)
+			for name, value := range ex.Header {
+				header.Set(name, value)
+			}
+
+			return &http.Response{
+				Status:        fmt.Sprintf("%d %s", ex.StatusCode, http.StatusText(ex.StatusCode)),
+				StatusCode:    ex.StatusCode,
+				Proto:         "HTTP/1.1",
+				ProtoMajor:    1,
+				ProtoMinor:    1,
+				Header:        header,
+				Body:          ioutil.NopCloser(strings.NewReader(ex.Response)),
+				ContentLength: int64(len(ex.Response)),
+				Request:       req,
+			}, nil
+		})
+	}, nil
+}
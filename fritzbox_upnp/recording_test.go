@@ -0,0 +1,82 @@
+package fritzbox_upnp
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	const response = `<s:Envelope><s:Body><u:GetInfoResponse>` +
+		`<NewPassword>secret</NewPassword>` +
+		`<NewUserName>admin</NewUserName>` +
+		`<NewDescription>admin uses secret</NewDescription>` +
+		`<NewX_AVM-DE_HostListPath>/devicehostlist.lua?sid=1234abcd</NewX_AVM-DE_HostListPath>` +
+		`</u:GetInfoResponse></s:Body></s:Envelope>`
+	const want = `<s:Envelope><s:Body><u:GetInfoResponse>` +
+		`<NewPassword>REDACTED</NewPassword>` +
+		`<NewUserName>admin</NewUserName>` +
+		`<NewDescription>admin uses secret</NewDescription>` +
+		`<NewX_AVM-DE_HostListPath>/devicehostlist.lua?sid=REDACTED</NewX_AVM-DE_HostListPath>` +
+		`</u:GetInfoResponse></s:Body></s:Envelope>`
+
+	record, err := RecordMiddleware(dir, DefaultRedactedElements)
+	if err != nil {
+		t.Fatal(err)
+	}
+	box := RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		header := make(http.Header)
+		header.Set("Content-Type", "text/xml")
+		header.Set("Set-Cookie", "sid=1234abcd")
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     header,
+			Body:       ioutil.NopCloser(strings.NewReader(response)),
+		}, nil
+	})
+
+	request := func() *http.Request {
+		req, _ := http.NewRequest("POST", "http://fritz.box:49000/upnp/control/deviceinfo", strings.NewReader("<NewPassword>secret</NewPassword>"))
+		req.Header.Set("SoapAction", "urn:dslforum-org:service:DeviceInfo:1#GetInfo")
+		req.Header.Set("Authorization", `Digest username="admin"`)
+		return req
+	}
+
+	resp, err := record(box).RoundTrip(request())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != response {
+		t.Errorf("recording changed the response to %s", body)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatalf("%d recordings, want 1", len(files))
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, leaked := range []string{"Digest", "1234abcd", "<NewPassword>secret"} {
+		if strings.Contains(string(data), leaked) {
+			t.Errorf("%q recorded in %s", leaked, data)
+		}
+	}
+
+	replay, err := ReplayMiddleware(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = replay(nil).RoundTrip(request())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != want {
+		t.Errorf("replayed %s, want %s", body, want)
+	}
+}
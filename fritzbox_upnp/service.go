@@ -16,17 +16,16 @@ package fritzbox_upnp
 // limitations under the License.
 
 import (
-	"bytes"
-	"crypto/md5"
-	"crypto/rand"
-	"crypto/tls"
+	"context"
 	"encoding/xml"
-	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // curl http://fritz.box:49000/igddesc.xml
@@ -38,7 +37,9 @@ import (
 
 const textXml = `text/xml; charset="utf-8"`
 
-var ErrInvalidSOAPResponse = errors.New("invalid SOAP response")
+// maximum number of retries of a call rejected with an accepted or stale nonce. Concurrent calls
+// reach a device checking the nonce count out of order, so a call may be rejected several times.
+const maxAuthRetries = 8
 
 // Root of the UPNP tree
 type Root struct {
@@ -46,7 +47,24 @@ type Root struct {
 	Username string
 	Password string
 	Device   Device              `xml:"device"`
-	Services map[string]*Service // Map of all services indexed by .ServiceType
+	Services map[string]*Service // Map of all services indexed by .ServiceType, #2, #3... appended for further services of a type
+
+	client *http.Client // HTTP client used for all requests to the device
+	logger *slog.Logger
+	hooks  Hooks
+
+	authLock         sync.Mutex       // protects challenge, login, authFailures and authBlockedUntil
+	challenge        *digestChallenge // last digest challenge of the device, reused for all calls
+	login            chan struct{}    // closed when the login with a new challenge is answered
+	authFailures     int              // logins rejected since the last accepted login
+	authBlockedUntil time.Time        // no credentials are sent until then
+	authBackoff      time.Duration
+	maxAuthBackoff   time.Duration
+}
+
+// root element of a device description
+type descRoot struct {
+	Device *Device `xml:"device"`
 }
 
 // An UPNP Device
@@ -97,7 +115,7 @@ type Action struct {
 	ArgumentMap map[string]*Argument // Map of arguments indexed by .Name
 }
 
-// An Inüut Argument to pass to an action
+// An Input Argument to pass to an action
 type ActionArgument struct {
 	Name  string
 	Value interface{}
@@ -147,9 +165,10 @@ type Argument struct {
 
 // A state variable that can be manipulated through actions
 type StateVariable struct {
-	Name         string `xml:"name"`
-	DataType     string `xml:"dataType"`
-	DefaultValue string `xml:"defaultValue"`
+	Name          string   `xml:"name"`
+	DataType      string   `xml:"dataType"`
+	DefaultValue  string   `xml:"defaultValue"`
+	AllowedValues []string `xml:"allowedValueList>allowedValue"` // possible values of string variables, if known
 }
 
 // The result of a Call() contains all output arguments of the call.
@@ -158,58 +177,79 @@ type StateVariable struct {
 type Result map[string]interface{}
 
 // load the whole tree
-func (r *Root) load() error {
-	igddesc, err := http.Get(
-		fmt.Sprintf("%s/igddesc.xml", r.BaseUrl),
-	)
+func (r *Root) load(ctx context.Context) error {
+	return r.loadDescription(ctx, "igddesc.xml", &r.Device)
+}
 
+func (r *Root) loadTr64(ctx context.Context) error {
+	return r.loadDescription(ctx, "tr64desc.xml", &Device{})
+}
+
+// get a document from the device
+func (r *Root) get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	defer igddesc.Body.Close()
+	return r.httpClient().Do(req)
+}
 
-	dec := xml.NewDecoder(igddesc.Body)
+// httpClient returns the client of the root or the default client for roots not created by NewRoot.
+func (r *Root) httpClient() *http.Client {
+	if r.client == nil {
+		return http.DefaultClient
+	}
+	return r.client
+}
 
-	err = dec.Decode(r)
-	if err != nil {
-		return err
+// log returns the logger of the root or the default logger for roots not created by NewRoot.
+func (r *Root) log() *slog.Logger {
+	if r.logger == nil {
+		return slog.Default()
 	}
+	return r.logger
+}
 
-	r.Services = make(map[string]*Service)
-	return r.Device.fillServices(r)
+// callHooks returns the hooks of the root or hooks doing nothing for roots not created by NewRoot.
+func (r *Root) callHooks() Hooks {
+	if r.hooks == nil {
+		return NopHooks{}
+	}
+	return r.hooks
 }
 
-func (r *Root) loadTr64() error {
-	igddesc, err := http.Get(
-		fmt.Sprintf("%s/tr64desc.xml", r.BaseUrl),
-	)
+// load a device description into d and add all its services to the root
+func (r *Root) loadDescription(ctx context.Context, name string, d *Device) error {
+	url := fmt.Sprintf("%s/%s", r.BaseUrl, name)
+	r.log().Debug("loading device description", "url", url)
+
+	desc, err := r.get(ctx, url)
 
 	if err != nil {
 		return err
 	}
 
-	defer igddesc.Body.Close()
+	defer desc.Body.Close()
 
-	dec := xml.NewDecoder(igddesc.Body)
+	dec := xml.NewDecoder(desc.Body)
 
-	err = dec.Decode(r)
+	err = dec.Decode(&descRoot{Device: d})
 	if err != nil {
 		return err
 	}
 
-	r.Services = make(map[string]*Service)
-	return r.Device.fillServices(r)
+	return d.fillServices(ctx, r)
 }
 
 // load all service descriptions
-func (d *Device) fillServices(r *Root) error {
+func (d *Device) fillServices(ctx context.Context, r *Root) error {
 	d.root = r
 
 	for _, s := range d.Services {
 		s.Device = d
 
-		response, err := http.Get(r.BaseUrl + s.SCPDUrl)
+		response, err := r.get(ctx, r.BaseUrl+s.SCPDUrl)
 		if err != nil {
 			return err
 		}
@@ -245,10 +285,12 @@ func (d *Device) fillServices(r *Root) error {
 			}
 		}
 
-		r.Services[s.ServiceType] = s
+		key := r.serviceKey(s.ServiceType)
+		r.Services[key] = s
+		r.log().Debug("loaded service", "service", key, "actions", len(s.Actions))
 	}
 	for _, d2 := range d.Devices {
-		err := d2.fillServices(r)
+		err := d2.fillServices(ctx, r)
 		if err != nil {
 			return err
 		}
@@ -256,6 +298,17 @@ func (d *Device) fillServices(r *Root) error {
 	return nil
 }
 
+// serviceKey returns the key of a service of the type in Services. The first service of a type
+// is indexed by its type, further services of the type in other devices like a second
+// WANConnectionDevice by the type followed by #2, #3 and so on.
+func (r *Root) serviceKey(serviceType string) string {
+	key := serviceType
+	for n := 2; r.Services[key] != nil; n++ {
+		key = fmt.Sprintf("%s#%d", serviceType, n)
+	}
+	return key
+}
+
 const SoapActionXML = `<?xml version="1.0" encoding="utf-8"?>` +
 	`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
 	`<s:Body><u:%s xmlns:u=%s>%s</u:%s xmlns:u=%s></s:Body>` +
@@ -263,20 +316,13 @@ const SoapActionXML = `<?xml version="1.0" encoding="utf-8"?>` +
 
 const SoapActionParamXML = `<%s>%s</%s>`
 
-func (a *Action) createCallHttpRequest(actionArg *ActionArgument) (*http.Request, error) {
-	argsString := ""
-	if actionArg != nil {
-		var buf bytes.Buffer
-		sValue := fmt.Sprintf("%v", actionArg.Value)
-		xml.EscapeText(&buf, []byte(sValue))
-		argsString += fmt.Sprintf(SoapActionParamXML, actionArg.Name, buf.String(), actionArg.Name)
-	}
+func (a *Action) createCallHttpRequest(ctx context.Context, argsString string) (*http.Request, error) {
 	bodystr := fmt.Sprintf(SoapActionXML, a.Name, a.service.ServiceType, argsString, a.Name, a.service.ServiceType)
 
 	url := a.service.Device.root.BaseUrl + a.service.ControlUrl
 	body := strings.NewReader(bodystr)
 
-	req, err := http.NewRequest("POST", url, body)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, body)
 	if err != nil {
 		return nil, err
 	}
@@ -289,135 +335,185 @@ func (a *Action) createCallHttpRequest(actionArg *ActionArgument) (*http.Request
 	return req, nil
 }
 
-// store auth header for reuse
-var authHeader = ""
+// Call an action with the given arguments. All input arguments of the action have to be given.
+// The values are converted into the data types of the arguments and sent in the order of the
+// action description. Arguments not matching the action fail with ErrArgumentMismatch.
+func (a *Action) Call(args ...*ActionArgument) (Result, error) {
+	return a.CallContext(context.Background(), args...)
+}
+
+// CallContext calls an action with the given arguments like Call. The call is aborted when the context is done.
+func (a *Action) CallContext(ctx context.Context, args ...*ActionArgument) (Result, error) {
+	start := time.Now()
+	result, err := a.call(ctx, args)
+	duration := time.Since(start)
 
-// Call an action with argument if given
-func (a *Action) Call(actionArg *ActionArgument) (Result, error) {
-	req, err := a.createCallHttpRequest(actionArg)
+	root := a.service.Device.root
+	root.callHooks().CallDone(a.service.ServiceType, a.Name, duration, err)
 
+	logArgs := []interface{}{"service", a.service.ServiceType, "action", a.Name, "duration", duration}
+	if values := argumentsLogValue(args); values != "" {
+		logArgs = append(logArgs, "arguments", values)
+	}
+
+	logger := root.log()
+	if err != nil {
+		logger.Debug("action failed", append(logArgs, "err", err)...)
+	} else {
+		logger.Debug("action called", logArgs...)
+	}
+
+	return result, err
+}
+
+func (a *Action) call(ctx context.Context, args []*ActionArgument) (Result, error) {
+	root := a.service.Device.root
+
+	argsString, err := a.encodeArguments(args)
 	if err != nil {
 		return nil, err
 	}
 
-	// reuse prior authHeader, to avoid unnecessary authentication
-	if authHeader != "" {
-		req.Header.Set("Authorization", authHeader)
+	req, err := a.createCallHttpRequest(ctx, argsString)
+
+	if err != nil {
+		return nil, err
 	}
 
-	// first try call without auth header
-	resp, err := http.DefaultClient.Do(req)
+	// reuse the prior challenge, to avoid unnecessary authentication
+	used, login := root.authorize(req)
+	defer func() {
+		if login {
+			root.endLogin()
+		}
+	}()
+
+	resp, err := root.httpClient().Do(req)
 
 	if err != nil {
 		return nil, err
 	}
 
-	wwwAuth := resp.Header.Get("WWW-Authenticate")
-	if resp.StatusCode == http.StatusUnauthorized {
+	for retries := 0; resp.StatusCode == http.StatusUnauthorized; {
 		resp.Body.Close() // close now, since we make a new request below or fail
 
-		if wwwAuth != "" && a.service.Device.root.Username != "" && a.service.Device.root.Password != "" {
-			// call failed, but we have a password so calculate header and try again
-			authHeader, err = a.getDigestAuthHeader(wwwAuth, a.service.Device.root.Username, a.service.Device.root.Password)
-			if err != nil {
-				return nil, errors.New(fmt.Sprintf("%s: %s", a.Name, err.Error))
-			}
+		if root.Username == "" || root.Password == "" {
+			return nil, fmt.Errorf("%w, but no username and password given", a.statusError(req, resp))
+		}
 
-			req, err = a.createCallHttpRequest(actionArg)
-			if err != nil {
-				return nil, errors.New(fmt.Sprintf("%s: %s", a.Name, err.Error))
+		if until, blocked := root.authBlocked(); blocked {
+			return nil, fmt.Errorf("%w until %s: %w", ErrAuthBlocked, until.Format(time.RFC3339), a.statusError(req, resp))
+		}
+
+		challenge, err := parseDigestChallenges(resp.Header.Values("WWW-Authenticate"))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", a.statusError(req, resp), err)
+		}
+
+		// Rejecting the answer to a fresh challenge means wrong credentials, unless only the
+		// nonce became stale. Do not try again, since repeated failed logins lock the account
+		// on the device. A nonce accepted before is rejected, when concurrent calls reach the
+		// device out of order. Unless the nonce is stale, the call is retried with the next
+		// nonce count once, before the new challenge is taken.
+		accepted := used != nil && root.nonceAccepted(used)
+		if used != nil && !accepted && !challenge.stale {
+			if until, counted := root.authFailed(used); counted {
+				root.log().Debug("credentials rejected", "service", a.service.ServiceType, "action", a.Name, "blocked_until", until)
+				root.callHooks().AuthFailed(a.service.ServiceType, a.Name, until)
+			}
+			return nil, a.statusError(req, resp)
+		}
+		if used != nil {
+			// calls waiting for the login of another call do not count
+			if retries >= maxAuthRetries {
+				return nil, a.statusError(req, resp)
 			}
+			retries++
+		}
 
-			req.Header.Set("Authorization", authHeader)
+		if !accepted || challenge.stale || retries > 1 {
+			root.log().Debug("authenticating", "service", a.service.ServiceType, "action", a.Name, "algorithm", challenge.algorithm, "stale", challenge.stale)
+			root.callHooks().Reauthenticated(a.service.ServiceType, a.Name)
+			root.replaceChallenge(used, challenge)
+		}
+		if login {
+			root.endLogin()
+			login = false
+		}
+		if err := root.waitLogin(ctx); err != nil {
+			return nil, fmt.Errorf("%s: %w", a.Name, err)
+		}
 
-			resp, err = http.DefaultClient.Do(req)
+		req, err = a.createCallHttpRequest(ctx, argsString)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", a.Name, err)
+		}
+		used, login = root.authorize(req)
 
-			if err != nil {
-				return nil, errors.New(fmt.Sprintf("%s: %s", a.Name, err.Error))
-			}
+		root.callHooks().Retried(a.service.ServiceType, a.Name)
+		resp, err = root.httpClient().Do(req)
 
-		} else {
-			return nil, errors.New(fmt.Sprintf("%s: Unauthorized, but no username and password given", a.Name))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", a.Name, err)
 		}
 	}
 
 	defer resp.Body.Close()
 
+	if used != nil {
+		root.authSucceeded(used)
+	}
+	if login {
+		root.endLogin()
+		login = false
+	}
+
 	if resp.StatusCode != http.StatusOK {
-		errMsg := fmt.Sprintf("%s (%d)", http.StatusText(resp.StatusCode), resp.StatusCode)
+		var callErr error = a.statusError(req, resp)
 		if resp.StatusCode == 500 {
 			buf := new(strings.Builder)
 			io.Copy(buf, resp.Body)
 			body := buf.String()
-			//fmt.Println(body)
 
 			var soapEnv SoapEnvelope
 			err := xml.Unmarshal([]byte(body), &soapEnv)
 			if err != nil {
-				errMsg = fmt.Sprintf("error decoding SOAPFault: %s", err.Error())
+				callErr = fmt.Errorf("%s: %w: error decoding SOAPFault: %s", a.Name, ErrInvalidSOAPResponse, err)
 			} else {
 				soapFault := soapEnv.Body.Fault
+				faultErr := &SoapFaultError{
+					FaultString: soapFault.FaultString,
+					Service:     a.service.ServiceType,
+					Action:      a.Name,
+				}
 
 				if soapFault.FaultString == "UPnPError" {
 					upe := soapFault.Detail.UpnpError
-
-					errMsg = fmt.Sprintf("SAOPFault: %s %d (%s)", soapFault.FaultString, upe.ErrorCode, upe.ErrorDescription)
-				} else {
-					errMsg = fmt.Sprintf("SAOPFault: %s", soapFault.FaultString)
+					faultErr.Code = upe.ErrorCode
+					faultErr.Description = upe.ErrorDescription
 				}
+				callErr = faultErr
 			}
 		}
-		return nil, errors.New(fmt.Sprintf("%s: %s", a.Name, errMsg))
+		return nil, callErr
 	}
 
-	return a.parseSoapResponse(resp.Body)
-}
-
-func (a *Action) getDigestAuthHeader(wwwAuth string, username string, password string) (string, error) {
-	// parse www-auth header
-	if !strings.HasPrefix(wwwAuth, "Digest ") {
-		return "", errors.New(fmt.Sprintf("WWW-Authentication header is not Digest: '%s'", wwwAuth))
-	}
-
-	s := wwwAuth[7:]
-	d := map[string]string{}
-	for _, kv := range strings.Split(s, ",") {
-		parts := strings.SplitN(kv, "=", 2)
-		if len(parts) != 2 {
-			continue
-		}
-		d[strings.Trim(parts[0], "\" ")] = strings.Trim(parts[1], "\" ")
+	result, err := a.parseSoapResponse(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", a.Name, err)
 	}
 
-	if d["algorithm"] == "" {
-		d["algorithm"] = "MD5"
-	} else if d["algorithm"] != "MD5" {
-		return "", errors.New(fmt.Sprintf("digest algorithm not supported: %s != MD5", d["algorithm"]))
-	}
+	return result, nil
+}
 
-	if d["qop"] != "auth" {
-		return "", errors.New(fmt.Sprintf("digest qop not supported: %s != auth", d["qop"]))
+// statusError returns the error for an unexpected HTTP status of a call
+func (a *Action) statusError(req *http.Request, resp *http.Response) *HTTPStatusError {
+	return &HTTPStatusError{
+		StatusCode: resp.StatusCode,
+		Service:    a.service.ServiceType,
+		Action:     a.Name,
+		URL:        req.URL.String(),
 	}
-
-	// calc h1 and h2
-	ha1 := fmt.Sprintf("%x", md5.Sum([]byte(username+":"+d["realm"]+":"+password)))
-
-	ha2 := fmt.Sprintf("%x", md5.Sum([]byte("POST:"+a.service.ControlUrl)))
-
-	cn := make([]byte, 8)
-	rand.Read(cn)
-	cnonce := fmt.Sprintf("%x", cn)
-
-	nCounter := 1
-	nc := fmt.Sprintf("%08x", nCounter)
-
-	ds := strings.Join([]string{ha1, d["nonce"], nc, cnonce, d["qop"], ha2}, ":")
-	response := fmt.Sprintf("%x", md5.Sum([]byte(ds)))
-
-	authHeader := fmt.Sprintf("Digest username=\"%s\", realm=\"%s\", nonce=\"%s\", uri=\"%s\", cnonce=\"%s\", nc=%s, qop=%s, response=\"%s\", algorithm=%s",
-		username, d["realm"], d["nonce"], a.service.ControlUrl, cnonce, nc, d["qop"], response, d["algorithm"])
-
-	return authHeader, nil
 }
 
 func (a *Action) parseSoapResponse(r io.Reader) (Result, error) {
@@ -431,7 +527,7 @@ func (a *Action) parseSoapResponse(r io.Reader) (Result, error) {
 		}
 
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%w: %s", ErrInvalidSOAPResponse, err)
 		}
 
 		if se, ok := t.(xml.StartElement); ok {
@@ -440,7 +536,7 @@ func (a *Action) parseSoapResponse(r io.Reader) (Result, error) {
 			if ok {
 				t2, err := dec.Token()
 				if err != nil {
-					return nil, err
+					return nil, fmt.Errorf("%w: %s", ErrInvalidSOAPResponse, err)
 				}
 
 				var val string
@@ -455,7 +551,7 @@ func (a *Action) parseSoapResponse(r io.Reader) (Result, error) {
 
 				converted, err := convertResult(val, arg)
 				if err != nil {
-					return nil, err
+					return nil, fmt.Errorf("%w: %s", ErrInvalidSOAPResponse, err)
 				}
 				res[arg.StateVariable.Name] = converted
 			}
@@ -494,37 +590,46 @@ func convertResult(val string, arg *Argument) (interface{}, error) {
 
 // Load the services tree from an device.
 func LoadServices(baseurl string, username string, password string, verifyTls bool) (*Root, error) {
+	return LoadServicesContext(context.Background(), baseurl, username, password, verifyTls)
+}
 
-	if !verifyTls && strings.HasPrefix(baseurl, "https://") {
+// LoadServicesContext loads the services tree from an device. Loading is aborted when the context is done.
+// Further options are applied after the TLS verification option.
+func LoadServicesContext(ctx context.Context, baseurl string, username string, password string, verifyTls bool, extraOptions ...Option) (*Root, error) {
+	var options []Option
+	if !verifyTls {
 		// disable certificate validation, since fritz.box uses self signed cert
-		http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		options = append(options, WithInsecureSkipVerify())
 	}
+	options = append(options, extraOptions...)
 
-	var root = &Root{
-		BaseUrl:  baseurl,
-		Username: username,
-		Password: password,
-	}
-
-	err := root.load()
+	root, err := NewRoot(baseurl, username, password, options...)
 	if err != nil {
 		return nil, err
 	}
 
-	var rootTr64 = &Root{
-		BaseUrl:  baseurl,
-		Username: username,
-		Password: password,
-	}
-
-	err = rootTr64.loadTr64()
+	err = root.LoadContext(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	for k, v := range rootTr64.Services {
-		root.Services[k] = v
+	return root, nil
+}
+
+// Load the services tree of the device. Services of the TR-064 description are added to the
+// services of the IGD description.
+func (r *Root) Load() error {
+	return r.LoadContext(context.Background())
+}
+
+// LoadContext loads the services tree of the device like Load. Loading is aborted when the context is done.
+func (r *Root) LoadContext(ctx context.Context) error {
+	r.Services = make(map[string]*Service)
+
+	err := r.load(ctx)
+	if err != nil {
+		return err
 	}
 
-	return root, nil
+	return r.loadTr64(ctx)
 }
@@ -0,0 +1,77 @@
+package fritzbox_upnp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// a gateway with two WAN devices, each with a WANIPConnection:1
+const duplicateServicesDesc = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0"><device>
+<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+<deviceList>
+<device><deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType><deviceList>
+<device><deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType><serviceList>
+<service><serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType><controlURL>/igdupnp/control/WANIPConn1</controlURL><SCPDURL>/igdconnSCPD.xml</SCPDURL></service>
+</serviceList></device>
+</deviceList></device>
+<device><deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType><deviceList>
+<device><deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType><serviceList>
+<service><serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType><controlURL>/igdupnp/control/WANIPConn2</controlURL><SCPDURL>/igdconnSCPD.xml</SCPDURL></service>
+</serviceList></device>
+</deviceList></device>
+</deviceList>
+</device></root>`
+
+const connectionSCPD = `<?xml version="1.0"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0"><actionList>
+<action><name>GetExternalIPAddress</name><argumentList>
+<argument><name>NewExternalIPAddress</name><direction>out</direction><relatedStateVariable>ExternalIPAddress</relatedStateVariable></argument>
+</argumentList></action>
+</actionList><serviceStateTable>
+<stateVariable><name>ExternalIPAddress</name><dataType>string</dataType></stateVariable>
+</serviceStateTable></scpd>`
+
+func TestLoadDuplicateServices(t *testing.T) {
+	docs := map[string]string{
+		"/igddesc.xml":     duplicateServicesDesc,
+		"/tr64desc.xml":    `<root><device></device></root>`,
+		"/igdconnSCPD.xml": connectionSCPD,
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		doc, ok := docs[req.URL.Path]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write([]byte(doc))
+	}))
+	defer ts.Close()
+
+	root, err := LoadServices(ts.URL, "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const serviceType = "urn:schemas-upnp-org:service:WANIPConnection:1"
+	for key, controlUrl := range map[string]string{
+		serviceType:        "/igdupnp/control/WANIPConn1",
+		serviceType + "#2": "/igdupnp/control/WANIPConn2",
+	} {
+		s, ok := root.Services[key]
+		if !ok {
+			t.Errorf("service %s not loaded", key)
+			continue
+		}
+		if s.ServiceType != serviceType || s.ControlUrl != controlUrl {
+			t.Errorf("service %s is %s at %s", key, s.ServiceType, s.ControlUrl)
+		}
+		if s.Actions["GetExternalIPAddress"] == nil {
+			t.Errorf("service %s without actions", key)
+		}
+	}
+	if len(root.Services) != 2 {
+		t.Errorf("%d services loaded, want 2", len(root.Services))
+	}
+}
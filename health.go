@@ -1,17 +1,46 @@
 package main
 
 import (
+	"fmt"
 	"github.com/heptiolabs/healthcheck"
 	"time"
 )
 
+// baseGoroutines is the number of goroutines of an idle exporter: the HTTP server, the pollers and the watchers.
+const baseGoroutines = 100
+
 // createHealthChecks will create the readiness and liveness endpoints and add the check functions.
-func createHealthChecks(gatewayUrl string) healthcheck.Handler {
+// The liveness check fails above maxGoroutines goroutines.
+func createHealthChecks(gatewayUrl string, collector *FritzboxCollector, maxGoroutines int) healthcheck.Handler {
 	health := healthcheck.NewHandler()
 
 	health.AddReadinessCheck("FRITZ!Box connection",
 		healthcheck.HTTPGetCheck(gatewayUrl+"/any.xml", time.Duration(3)*time.Second))
+	health.AddReadinessCheck("FRITZ!Box credentials", credentialsCheck(collector))
 
-	health.AddLivenessCheck("go-routines", healthcheck.GoroutineCountCheck(100))
+	health.AddLivenessCheck("go-routines", healthcheck.GoroutineCountCheck(maxGoroutines))
 	return health
 }
+
+// credentialsCheck fails while the FRITZ!Box rejects the credentials of the collector.
+func credentialsCheck(fc *FritzboxCollector) healthcheck.Check {
+	return func() error {
+		root := fc.root()
+		if root == nil {
+			return nil
+		}
+
+		failures, blockedUntil := root.AuthState()
+		if failures > 0 {
+			return fmt.Errorf("credentials rejected %d times, not sent until %s", failures, blockedUntil.Format(time.RFC3339))
+		}
+		return nil
+	}
+}
+
+// goroutineLimit returns the number of goroutines expected at most while the given number of collectors
+// scrape at the same time. Each scrape runs a worker per concurrent request, each request holds a
+// connection with a read and a write loop.
+func goroutineLimit(maxConcurrency, collectors int) int {
+	return baseGoroutines + 3*maxConcurrency*collectors
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	upnp "gitlab.com/dekarl/fritzbox_exporter/fritzbox_upnp"
+)
+
+// soapMetrics are the metrics of the calls of actions of a FRITZ!Box.
+type soapMetrics struct {
+	requestDuration   *prometheus.HistogramVec
+	requests          *prometheus.CounterVec
+	retries           *prometheus.CounterVec
+	reauthentications *prometheus.CounterVec
+	authFailures      prometheus.Counter
+}
+
+func newSoapMetrics() *soapMetrics {
+	return &soapMetrics{
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "fritzbox_soap_request_duration_seconds",
+			Help:    "Duration of the calls of actions, including retries.",
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+		}, []string{"service", "action"}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "fritzbox_soap_requests_total",
+			Help: "Number of calls of actions.",
+		}, []string{"service", "action"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "fritzbox_soap_retries_total",
+			Help: "Number of requests of calls sent again.",
+		}, []string{"service", "action"}),
+		reauthentications: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "fritzbox_soap_reauthentications_total",
+			Help: "Number of digest authentications computed for calls.",
+		}, []string{"service", "action"}),
+		authFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "fritzbox_auth_failures_total",
+			Help: "Number of logins the FRITZ!Box rejected because of wrong credentials.",
+		}),
+	}
+}
+
+// SOAP metrics of the FRITZ!Box given by -gateway-url, registered in the default registry
+var defaultSoapMetrics = newSoapMetrics()
+
+var (
+	soapCallsDesc = prometheus.NewDesc(
+		"fritzbox_scrape_soap_calls",
+		"Number of actions called to collect the metrics of the last scrape.",
+		nil, nil)
+	authBlockedUntilDesc = prometheus.NewDesc(
+		"fritzbox_auth_blocked_until_timestamp_seconds",
+		"Time until which no credentials are sent, since the FRITZ!Box rejected them. 0 if not blocked.",
+		nil, nil)
+)
+
+// collectors returns the collectors of the metrics.
+func (m *soapMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.requestDuration, m.requests, m.retries, m.reauthentications, m.authFailures}
+}
+
+// soapHooks records the calls of actions in the SOAP metrics.
+type soapHooks struct {
+	upnp.NopHooks
+	metrics *soapMetrics
+}
+
+func (h soapHooks) CallDone(service string, action string, duration time.Duration, err error) {
+	h.metrics.requests.WithLabelValues(service, action).Inc()
+	h.metrics.requestDuration.WithLabelValues(service, action).Observe(duration.Seconds())
+}
+
+func (h soapHooks) Retried(service string, action string) {
+	h.metrics.retries.WithLabelValues(service, action).Inc()
+}
+
+func (h soapHooks) Reauthenticated(service string, action string) {
+	h.metrics.reauthentications.WithLabelValues(service, action).Inc()
+}
+
+func (h soapHooks) AuthFailed(service string, action string, blockedUntil time.Time) {
+	h.metrics.authFailures.Inc()
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// built-in labels, which are not taken from the results of an action
+const (
+	labelGateway  = "gateway"          // host name of the FRITZ!Box
+	labelModel    = "model"            // model name of the FRITZ!Box
+	labelSerial   = "serial"           // serial number of the FRITZ!Box
+	labelFirmware = "firmware"         // firmware version of the FRITZ!Box
+	labelInstance = "service_instance" // instance number of the service, instance is set by Prometheus
+)
+
+// labels taken from the device information of the FRITZ!Box
+var deviceLabels = []string{labelModel, labelSerial, labelFirmware}
+
+// service and action providing the device information
+const (
+	deviceInfoService = "urn:dslforum-org:service:DeviceInfo:1"
+	deviceInfoAction  = "GetInfo"
+)
+
+// cases of label values
+const (
+	caseLower = "lower" // convert to lower case
+	caseUpper = "upper" // convert to upper case
+	caseKeep  = "keep"  // keep the value as it is
+)
+
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// A LabelOption changes the name and the values of a label of a metric.
+type LabelOption struct {
+	Name        string `json:"name"`        // name of the label, the lower case name of the result if not given
+	Case        string `json:"case"`        // "lower", "upper" or "keep", lower for labels taken from results if not given
+	Pattern     string `json:"pattern"`     // regular expression replaced in the value
+	Replacement string `json:"replacement"` // replacement of the pattern, may refer to groups like $1
+
+	regexp *regexp.Regexp
+}
+
+// init checks the option and prepares it for use.
+func (o *LabelOption) init() error {
+	if o.Name != "" && !labelNamePattern.MatchString(o.Name) {
+		return fmt.Errorf("invalid label name %q", o.Name)
+	}
+
+	switch o.Case {
+	case "", caseLower, caseUpper, caseKeep:
+	default:
+		return fmt.Errorf("unknown case %q", o.Case)
+	}
+
+	if o.Pattern != "" {
+		re, err := regexp.Compile(o.Pattern)
+		if err != nil {
+			return err
+		}
+		o.regexp = re
+	}
+
+	return nil
+}
+
+// labelName returns the name of the label reporting the result or built-in label.
+func (m *Metric) labelName(label string) string {
+	if o, ok := m.Labels[label]; ok && o.Name != "" {
+		return o.Name
+	}
+	return strings.ToLower(label)
+}
+
+// labelValue applies the options of the label to its value. Values of labels taken from results are
+// converted to lower case by default, to avoid problems with labels like the host name.
+func (m *Metric) labelValue(label string, value string) string {
+	o, ok := m.Labels[label]
+	if !ok {
+		o = &LabelOption{}
+	}
+
+	if o.regexp != nil {
+		value = o.regexp.ReplaceAllString(value, o.Replacement)
+	}
+
+	c := o.Case
+	if c == "" && isResultLabel(m, label) {
+		c = caseLower
+	}
+
+	switch c {
+	case caseLower:
+		return strings.ToLower(value)
+	case caseUpper:
+		return strings.ToUpper(value)
+	}
+	return value
+}
+
+// initLabels checks the label options of the metric and returns the names of its variable labels
+// and its constant labels, which include the external labels.
+func (m *Metric) initLabels(externalLabels map[string]string) ([]string, prometheus.Labels, error) {
+	sources := append([]string{}, m.PromDesc.VarLabels...)
+	if m.Kind == kindStateSet {
+		// the state is reported in a label named like the result
+		sources = append(sources, m.Result)
+	}
+
+	for label, o := range m.Labels {
+		found := false
+		for _, l := range sources {
+			found = found || l == label
+		}
+		if !found {
+			return nil, nil, fmt.Errorf("options for label %s, which is not reported", label)
+		}
+
+		err := o.init()
+		if err != nil {
+			return nil, nil, fmt.Errorf("label %s: %s", label, err)
+		}
+	}
+
+	names := make([]string, len(sources))
+	used := make(map[string]bool)
+	for i, l := range sources {
+		names[i] = m.labelName(l)
+		if used[names[i]] {
+			return nil, nil, fmt.Errorf("label %s reported twice", names[i])
+		}
+		used[names[i]] = true
+	}
+
+	constLabels := prometheus.Labels{}
+	for name, value := range externalLabels {
+		constLabels[name] = value
+	}
+	for name, value := range m.ConstLabels {
+		if !labelNamePattern.MatchString(name) {
+			return nil, nil, fmt.Errorf("invalid label name %q", name)
+		}
+		constLabels[name] = value
+	}
+	for name := range constLabels {
+		if used[name] {
+			return nil, nil, fmt.Errorf("constant label %s is also a variable label", name)
+		}
+	}
+
+	return names, constLabels, nil
+}
+
+// parseExternalLabels parses comma separated name=value pairs.
+func parseExternalLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		name, value, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !labelNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid external label %q", pair)
+		}
+		labels[name] = strings.TrimSpace(value)
+	}
+
+	return labels, nil
+}
+
+// isBuiltinLabel returns true for the labels provided for all metrics.
+func isBuiltinLabel(label string) bool {
+	switch label {
+	case labelGateway, labelModel, labelSerial, labelFirmware, labelInstance:
+		return true
+	}
+	return false
+}
+
+// isExtraLabel returns true for labels not taken from the results of the action.
+func isExtraLabel(m *Metric, label string) bool {
+	if isBuiltinLabel(label) || label == m.InstanceLabel || label == m.InstanceNameLabel {
+		return true
+	}
+
+	for _, aa := range m.ActionArguments {
+		if _, ok := aa.ResultLabels[label]; ok || label == aa.Label {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isResultLabel returns true for labels taken from the results of the action or of provider actions.
+func isResultLabel(m *Metric, label string) bool {
+	for _, aa := range m.ActionArguments {
+		if _, ok := aa.ResultLabels[label]; ok {
+			return true
+		}
+	}
+
+	return !isExtraLabel(m, label)
+}
+
+// hasResultLabels returns true if any label of the metric is taken from results.
+func hasResultLabels(m *Metric) bool {
+	for _, l := range m.PromDesc.VarLabels {
+		if isResultLabel(m, l) {
+			return true
+		}
+	}
+	return false
+}
+
+// usesDeviceLabels returns true if a metric reports labels taken from the device information.
+func usesDeviceLabels(metrics []*Metric) bool {
+	for _, m := range metrics {
+		for _, l := range m.PromDesc.VarLabels {
+			for _, d := range deviceLabels {
+				if l == d {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestParseExternalLabels(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"", map[string]string{}, false},
+		{"site=home", map[string]string{"site": "home"}, false},
+		{" site = home , rack=1,", map[string]string{"site": "home", "rack": "1"}, false},
+		{"site=", map[string]string{"site": ""}, false},
+		{"note=a=b", map[string]string{"note": "a=b"}, false},
+		{"site", nil, true},
+		{"=home", nil, true},
+		{"1site=home", nil, true},
+		{"site-name=home", nil, true},
+		{"site=home,rack", nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseExternalLabels(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseExternalLabels(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseExternalLabels(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestInitLabels(t *testing.T) {
+	tests := []struct {
+		name           string
+		metric         string // fields added to the definition
+		externalLabels map[string]string
+		wantLabels     []string
+		wantConst      prometheus.Labels
+		wantErr        string
+	}{
+		{
+			name:       "lower case names",
+			wantLabels: []string{"gateway", "hostname", "ipaddress"},
+			wantConst:  prometheus.Labels{},
+		},
+		{
+			name:       "renamed label",
+			metric:     `"labels": {"IPAddress": {"name": "ip"}},`,
+			wantLabels: []string{"gateway", "hostname", "ip"},
+			wantConst:  prometheus.Labels{},
+		},
+		{
+			name:           "external and constant labels",
+			metric:         `"constLabels": {"network": "home"},`,
+			externalLabels: map[string]string{"site": "berlin"},
+			wantLabels:     []string{"gateway", "hostname", "ipaddress"},
+			wantConst:      prometheus.Labels{"network": "home", "site": "berlin"},
+		},
+		{
+			name:           "constant label replaces external label",
+			metric:         `"constLabels": {"site": "hamburg"},`,
+			externalLabels: map[string]string{"site": "berlin"},
+			wantLabels:     []string{"gateway", "hostname", "ipaddress"},
+			wantConst:      prometheus.Labels{"site": "hamburg"},
+		},
+		{
+			name:           "external label clashes with built-in label",
+			externalLabels: map[string]string{"gateway": "fritz.box"},
+			wantErr:        "constant label gateway is also a variable label",
+		},
+		{
+			name:           "external label clashes with result label",
+			externalLabels: map[string]string{"hostname": "laptop"},
+			wantErr:        "constant label hostname is also a variable label",
+		},
+		{
+			name:           "external label clashes with renamed label",
+			metric:         `"labels": {"IPAddress": {"name": "site"}},`,
+			externalLabels: map[string]string{"site": "berlin"},
+			wantErr:        "constant label site is also a variable label",
+		},
+		{
+			name:    "constant label clashes with variable label",
+			metric:  `"constLabels": {"ipaddress": "none"},`,
+			wantErr: "constant label ipaddress is also a variable label",
+		},
+		{
+			name:    "invalid constant label name",
+			metric:  `"constLabels": {"home-network": "yes"},`,
+			wantErr: `invalid label name "home-network"`,
+		},
+		{
+			name:    "invalid renamed label",
+			metric:  `"labels": {"IPAddress": {"name": "ip address"}},`,
+			wantErr: `invalid label name "ip address"`,
+		},
+		{
+			name:    "renamed label clashes with label",
+			metric:  `"labels": {"IPAddress": {"name": "hostname"}},`,
+			wantErr: "label hostname reported twice",
+		},
+		{
+			name:    "options of a label not reported",
+			metric:  `"labels": {"MACAddress": {"case": "upper"}},`,
+			wantErr: "options for label MACAddress, which is not reported",
+		},
+		{
+			name:    "unknown case",
+			metric:  `"labels": {"HostName": {"case": "title"}},`,
+			wantErr: `unknown case "title"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m Metric
+			err := json.Unmarshal([]byte(`{
+				"service": "urn:dslforum-org:service:Hosts:1",
+				"action": "GetGenericHostEntry",
+				"result": "Active",
+				`+tt.metric+`
+				"promDesc": {"fqName": "test_host_active", "help": "active hosts", "varLabels": ["gateway", "HostName", "IPAddress"]},
+				"promType": "GaugeValue"
+			}`), &m)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			labels, constLabels, err := m.initLabels(tt.externalLabels)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("initLabels() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(labels, tt.wantLabels) {
+				t.Errorf("labels %v, want %v", labels, tt.wantLabels)
+			}
+			if !reflect.DeepEqual(constLabels, tt.wantConst) {
+				t.Errorf("constant labels %v, want %v", constLabels, tt.wantConst)
+			}
+		})
+	}
+}
+
+func TestParseMetricsExternalLabels(t *testing.T) {
+	metrics, err := parseMetrics([]byte(testMetrics), map[string]string{"site": "berlin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range metrics {
+		if !strings.Contains(m.Desc.String(), `site="berlin"`) {
+			t.Errorf("external label missing in %s", m.Desc)
+		}
+	}
+
+	_, err = parseMetrics([]byte(testMetrics), map[string]string{"gateway": "fritz.box"})
+	if err == nil || !strings.Contains(err.Error(), "invalid labels of test_wan_bytes_sent") {
+		t.Errorf("external label clashing with the gateway label accepted: %v", err)
+	}
+}
+
+func TestLabelValue(t *testing.T) {
+	metrics, err := parseMetrics([]byte(`[{
+		"service": "urn:dslforum-org:service:Hosts:1",
+		"action": "GetGenericHostEntry",
+		"result": "Active",
+		"labels": {
+			"HostName": {"case": "keep"},
+			"MACAddress": {"pattern": ":", "replacement": "-", "case": "upper"},
+			"model": {"case": "lower"}
+		},
+		"promDesc": {"fqName": "test_host_active", "help": "active hosts", "varLabels": ["gateway", "model", "HostName", "MACAddress", "InterfaceType"]},
+		"promType": "GaugeValue"
+	}]`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := metrics[0]
+
+	tests := []struct {
+		label string
+		value string
+		want  string
+	}{
+		{"gateway", "Fritz.Box", "Fritz.Box"}, // built-in labels are kept
+		{"model", "FRITZ!Box 7590", "fritz!box 7590"},
+		{"HostName", "Laptop", "Laptop"},
+		{"MACAddress", "3c:a6:2f:00:00:01", "3C-A6-2F-00-00-01"},
+		{"InterfaceType", "Ethernet", "ethernet"}, // results are lower case by default
+	}
+
+	for _, tt := range tests {
+		if got := m.labelValue(tt.label, tt.value); got != tt.want {
+			t.Errorf("labelValue(%s, %q) = %q, want %q", tt.label, tt.value, got, tt.want)
+		}
+	}
+}
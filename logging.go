@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// newLogger creates a logger writing messages of the given level or above to w.
+// The format is either logfmt or json.
+func newLogger(w io.Writer, level string, format string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: l}
+
+	var handler slog.Handler
+	switch format {
+	case "logfmt":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+
+	return slog.New(handler), nil
+}
+
+// time for which repeated warnings and errors are suppressed
+const logDedupInterval = 15 * time.Minute
+
+// dedupHandler suppresses warnings and errors repeating within the interval, so a permanently
+// failing action is not logged on every scrape. When the interval has passed, flush logs each
+// repeated message once more with the number of repetitions.
+type dedupHandler struct {
+	next   slog.Handler
+	prefix string // attributes and groups added to the handler, part of the key of a message
+	state  *dedupState
+}
+
+// state shared by all handlers of a collector, so messages are suppressed across scrapes
+type dedupState struct {
+	sync.Mutex
+	interval time.Duration
+	seen     map[string]*dedupEntry
+	order    []string // keys in the order the messages were logged first
+}
+
+type dedupEntry struct {
+	next     slog.Handler // handler the message was logged with
+	record   slog.Record  // message logged first
+	logged   time.Time    // time the message was logged last
+	repeated int          // repetitions suppressed since then
+}
+
+func newDedupState(interval time.Duration) *dedupState {
+	return &dedupState{interval: interval, seen: make(map[string]*dedupEntry)}
+}
+
+// newDedupLogger returns a logger suppressing the messages repeated within the interval of the state.
+func newDedupLogger(logger *slog.Logger, state *dedupState) *slog.Logger {
+	return slog.New(&dedupHandler{next: logger.Handler(), state: state})
+}
+
+func (h *dedupHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *dedupHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelWarn || !h.state.repeated(h.key(r), h.next, r) {
+		return h.next.Handle(ctx, r)
+	}
+	return nil
+}
+
+// repeated returns true if the message was logged within the interval and counts the repetition.
+func (s *dedupState) repeated(key string, next slog.Handler, r slog.Record) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	entry, ok := s.seen[key]
+	if ok && r.Time.Sub(entry.logged) < s.interval {
+		entry.repeated++
+		return true
+	}
+
+	if !ok {
+		entry = &dedupEntry{}
+		s.seen[key] = entry
+		s.order = append(s.order, key)
+	}
+	entry.next = next
+	entry.record = r.Clone()
+	entry.logged = r.Time
+	entry.repeated = 0
+	return false
+}
+
+// flush logs each message repeated since the interval passed once more with the number of
+// repetitions and forgets the messages not repeated within the interval.
+func (s *dedupState) flush(ctx context.Context, now time.Time) {
+	var summaries []*dedupEntry
+
+	s.Lock()
+	order := s.order[:0]
+	for _, key := range s.order {
+		entry := s.seen[key]
+		if now.Sub(entry.logged) < s.interval {
+			order = append(order, key)
+			continue
+		}
+		if entry.repeated == 0 {
+			delete(s.seen, key)
+			continue
+		}
+
+		summary := *entry
+		summaries = append(summaries, &summary)
+		entry.logged = now
+		entry.repeated = 0
+		order = append(order, key)
+	}
+	s.order = order
+	s.Unlock()
+
+	for _, entry := range summaries {
+		r := entry.record.Clone()
+		r.Time = now
+		r.AddAttrs(slog.Int("repeated", entry.repeated))
+		entry.next.Handle(ctx, r)
+	}
+}
+
+// key identifies a message by its level, text and attributes
+func (h *dedupHandler) key(r slog.Record) string {
+	var key strings.Builder
+	key.WriteString(h.prefix)
+	key.WriteString(r.Level.String())
+	key.WriteString("|")
+	key.WriteString(r.Message)
+
+	r.Attrs(func(a slog.Attr) bool {
+		key.WriteString("|")
+		key.WriteString(a.String())
+		return true
+	})
+
+	return key.String()
+}
+
+func (h *dedupHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	prefix := h.prefix
+	for _, a := range attrs {
+		prefix += a.String() + "|"
+	}
+
+	return &dedupHandler{next: h.next.WithAttrs(attrs), prefix: prefix, state: h.state}
+}
+
+func (h *dedupHandler) WithGroup(name string) slog.Handler {
+	return &dedupHandler{next: h.next.WithGroup(name), prefix: h.prefix + name + ".", state: h.state}
+}
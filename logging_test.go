@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogDedup(t *testing.T) {
+	var out bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	dedup := newDedupState(logDedupInterval)
+
+	lines := func() []string {
+		defer out.Reset()
+		if out.Len() == 0 {
+			return nil
+		}
+		return strings.Split(strings.TrimSpace(out.String()), "\n")
+	}
+
+	// two scrapes in a row log the same errors
+	for i := 0; i < 2; i++ {
+		sc := newScrape(context.Background(), nil, logger, dedup)
+		for j := 0; j < 3; j++ {
+			sc.logger.Error("cannot call action", "action", "GetUnknown")
+			sc.logger.With("gateway", "fritz.box").Warn("missing result for label", "label", "HostName")
+			sc.logger.Debug("action called", "action", "GetInfo")
+		}
+		sc.flushLog()
+
+		want := 3 // the debug messages are never suppressed
+		if i == 0 {
+			want += 2
+		}
+		if n := len(lines()); n != want {
+			t.Errorf("scrape %d: %d messages logged, want %d", i+1, n, want)
+		}
+	}
+
+	// the repetitions are reported once the interval passed
+	dedup.flush(context.Background(), time.Now().Add(logDedupInterval))
+	summaries := lines()
+	if len(summaries) != 2 {
+		t.Fatalf("%d summaries logged, want 2: %v", len(summaries), summaries)
+	}
+	if !strings.Contains(summaries[0], "action=GetUnknown repeated=5") {
+		t.Errorf("unexpected summary %s", summaries[0])
+	}
+	if !strings.Contains(summaries[1], "gateway=fritz.box label=HostName repeated=5") {
+		t.Errorf("unexpected summary %s", summaries[1])
+	}
+
+	// messages not repeated within the interval are forgotten
+	dedup.flush(context.Background(), time.Now().Add(2*logDedupInterval))
+	if n := len(lines()); n != 0 {
+		t.Errorf("%d summaries logged without repetitions", n)
+	}
+	if n := len(dedup.seen); n != 0 {
+		t.Errorf("%d messages remembered", n)
+	}
+	newScrape(context.Background(), nil, logger, dedup).logger.Error("cannot call action", "action", "GetUnknown")
+	if n := len(lines()); n != 1 {
+		t.Errorf("forgotten message not logged again")
+	}
+}
@@ -16,13 +16,15 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"os"
 	"sort"
 	"strconv"
 	"strings"
@@ -31,32 +33,52 @@ import (
 
 	"github.com/namsral/flag"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	upnp "gitlab.com/dekarl/fritzbox_exporter/fritzbox_upnp"
 )
 
 const serviceLoadRetryTime = 1 * time.Minute
 
-var (
-	flagTest    = flag.Bool("test", false, "print all available metrics to stdout")
-	flagCollect = flag.Bool("collect", false, "print configured metrics to stdout and exit")
-	flagJsonOut = flag.String("json-out", "", "store metrics also to JSON file when running test")
+// time after which actions the FRITZ!Box did not support are called again
+const unsupportedRetryTime = 1 * time.Hour
 
-	flagAddr        = flag.String("listen-address", "127.0.0.1:9042", "The address to listen on for HTTP requests.")
-	flagMetricsFile = flag.String("metrics-file", "metrics.json", "The JSON file with the metric definitions.")
+var (
+	flagTest     = flag.Bool("test", false, "print all available metrics to stdout")
+	flagCollect  = flag.Bool("collect", false, "print configured metrics to stdout and exit")
+	flagValidate = flag.Bool("validate", false, "validate the metric definitions against the FRITZ!Box and exit")
+	flagJsonOut  = flag.String("json-out", "", "store metrics also to JSON file when running test")
+
+	flagAddr                = flag.String("listen-address", "127.0.0.1:9042", "The address to listen on for HTTP requests.")
+	flagScrapeTimeout       = flag.Duration("scrape-timeout", 10*time.Second, "The scrape timeout used if Prometheus does not send one.")
+	flagScrapeTimeoutOffset = flag.Duration("scrape-timeout-offset", 500*time.Millisecond, "Offset to subtract from the scrape timeout sent by Prometheus.")
+	flagMetricsFile         = flag.String("metrics-file", "metrics.json", "The JSON file with the metric definitions.")
+	flagModulesFile         = flag.String("modules-file", "", "The JSON file with the module definitions used by the /probe endpoint.")
+	flagWatchInterval       = flag.Duration("watch-interval", 30*time.Second, "Check the metrics files for changes in this interval (0 disables checking)")
 
 	flagGatewayUrl       = flag.String("gateway-url", "http://fritz.box:49000", "The URL of the FRITZ!Box")
 	flagGatewayUsername  = flag.String("username", "", "The user for the FRITZ!Box UPnP service")
 	flagGatewayPassword  = flag.String("password", "", "The password for the FRITZ!Box UPnP service")
 	flagGatewayVerifyTLS = flag.Bool("verifyTls", false, "Verify the tls connection when connecting to the FRITZ!Box")
-)
-
-var (
-	collectErrors = prometheus.NewCounter(prometheus.CounterOpts{
-		Name: "fritzbox_exporter_collect_errors",
-		Help: "Number of collection errors.",
-	})
+	flagGatewayCAFile    = flag.String("ca-file", "", "PEM encoded CA bundle to verify the tls connection to the FRITZ!Box")
+	flagGatewayProxyUrl  = flag.String("proxy-url", "", "The URL of a proxy used to connect to the FRITZ!Box")
+	flagGatewayTimeout   = flag.Duration("gateway-timeout", 30*time.Second, "The timeout for each request to the FRITZ!Box")
+	flagMaxConcurrency   = flag.Int("max-concurrent-requests", 4, "The maximum number of concurrent requests to the FRITZ!Box")
+	flagRecordDir        = flag.String("record", "", "Record all requests to the FRITZ!Box and their responses into this directory")
+	flagRecordRedact     = flag.String("record.redact", strings.Join(upnp.DefaultRedactedElements, ","), "Comma separated elements whose values are redacted in recordings")
+	flagReplayDir        = flag.String("replay", "", "Answer all requests to the FRITZ!Box with the recordings in this directory instead")
+	flagRateLimit        = flag.Float64("rate-limit", 0, "The maximum number of requests per second to the FRITZ!Box (0 disables the limit)")
+	flagPollInterval     = flag.Duration("poll-interval", 0, "Poll the FRITZ!Box in the background with this interval instead of on each scrape (0 disables polling)")
+
+	flagMaxSeries           = flag.Int("max-series", 0, "The maximum number of series reported by the metric definitions per scrape (0 disables the limit)")
+	flagMaxSeriesPerMetric  = flag.Int("max-series-per-metric", 0, "The maximum number of series of a metric without maxSeries (0 disables the limit)")
+	flagSeriesLimitPolicy   = flag.String("series-limit-policy", policyTruncate, "What to do with metrics exceeding their series limit without seriesLimitPolicy (drop, truncate, other)")
+	flagExternalLabels      = flag.String("external-labels", "", "Comma separated name=value pairs added as labels to all metrics of the metric definitions")
+	flagMaxLabelValueLength = flag.Int("max-label-value-length", defaultMaxLabelValueLength, "Label values are shortened to this number of bytes (0 disables shortening)")
+
+	flagMaxGoroutines = flag.Int("max-goroutines", 0, "The liveness check fails above this number of goroutines (0 derives it from -max-concurrent-requests)")
+
+	flagLogLevel  = flag.String("log.level", "info", "Only log messages with the given severity or above (debug, info, warn, error)")
+	flagLogFormat = flag.String("log.format", "logfmt", "Output format of log messages (logfmt, json)")
 )
 
 type JsonPromDesc struct {
@@ -65,39 +87,94 @@ type JsonPromDesc struct {
 	VarLabels []string `json:"varLabels"`
 }
 
+// An input argument of the action of a metric. The value is given, the result of the provider action
+// named by Value or, for an index, each number below that result. The provider action is called with
+// its own arguments, which can take the values of previous arguments, e.g. the index of an outer loop.
 type ActionArg struct {
-	Name           string `json:"Name"`
-	IsIndex        bool   `json:"IsIndex"`
-	ProviderAction string `json:"ProviderAction"`
-	Value          string `json:"Value"`
+	Name              string            `json:"Name"`
+	IsIndex           bool              `json:"IsIndex"`
+	ProviderAction    string            `json:"ProviderAction"`
+	ProviderArguments []*ActionArg      `json:"ProviderArguments"` // arguments of the provider action
+	Argument          string            `json:"Argument"`          // for provider arguments: take the value of this previous argument
+	Value             string            `json:"Value"`
+	Label             string            `json:"Label"`        // label reporting the value of the argument
+	ResultLabels      map[string]string `json:"ResultLabels"` // labels reporting results of the provider action, by label name
 }
 
+// source of metrics whose results are read from a list returned as path by the action
+const sourceList = "list"
+
+// kinds of metrics besides plain values
+const (
+	kindInfo     = "info"     // constant 1 with the results given as labels
+	kindStateSet = "stateset" // a series per possible state with 1 for the current state
+)
+
 type Metric struct {
 	// initialized loading JSON
-	Service        string       `json:"service"`
-	Action         string       `json:"action"`
-	ActionArgument *ActionArg   `json:"actionArgument"`
-	Result         string       `json:"result"`
-	OkValue        string       `json:"okValue"`
-	PromDesc       JsonPromDesc `json:"promDesc"`
-	PromType       string       `json:"promType"`
+	Service           string                  `json:"service"`           // service type, may contain * to match multiple instances
+	InstanceLabel     string                  `json:"instanceLabel"`     // label for the instance number of the service
+	InstanceNameLabel string                  `json:"instanceNameLabel"` // label for the name of the instance
+	InstanceNames     map[string]string       `json:"instanceNames"`     // names of the instances by number
+	Action            string                  `json:"action"`
+	ActionArgument    *ActionArg              `json:"actionArgument"`  // single argument, prepended to the arguments
+	ActionArguments   []*ActionArg            `json:"actionArguments"` // input arguments of the action
+	Source            string                  `json:"source"`          // "list" to report a metric for each entry of a list
+	ListPath          string                  `json:"listPath"`        // result of the action containing the path of the list
+	Kind              string                  `json:"kind"`            // "info" or "stateset", empty for plain values
+	Result            string                  `json:"result"`
+	OkValue           string                  `json:"okValue"`
+	States            []string                `json:"states"`     // possible states of a stateset metric
+	Transforms        []*Transform            `json:"transforms"` // conversions applied to the result before reporting
+	Filter            []*Filter               `json:"filter"`     // conditions the results have to meet to be reported
+	Aggregate         string                  `json:"aggregate"`  // "count", "sum", "min" or "max" to report one series per label values
+	PromDesc          JsonPromDesc            `json:"promDesc"`
+	PromType          string                  `json:"promType"`
+	Interval          string                  `json:"interval"`          // interval for background polling, e.g. "5m"
+	Labels            map[string]*LabelOption `json:"labels"`            // options of the labels by the name in varLabels
+	ConstLabels       map[string]string       `json:"constLabels"`       // labels with constant values
+	MaxSeries         int                     `json:"maxSeries"`         // maximum number of series, -max-series-per-metric if 0
+	SeriesLimitPolicy string                  `json:"seriesLimitPolicy"` // "drop", "truncate" or "other", -series-limit-policy if empty
 
 	// initialized at startup
-	Desc       *prometheus.Desc
-	MetricType prometheus.ValueType
+	Desc         *prometheus.Desc
+	MetricType   prometheus.ValueType
+	PollInterval time.Duration
 }
 
-var metrics []*Metric
-
 type FritzboxCollector struct {
 	Url       string
 	Gateway   string
 	Username  string
 	Password  string
 	VerifyTls bool
+	CAFile    string
+	ProxyUrl  string
+	Timeout   time.Duration
+	Metrics   []*Metric
+
+	MaxConcurrency int          // maximum number of concurrent calls to the FRITZ!Box
+	RateLimit      float64      // maximum number of requests per second to the FRITZ!Box, 0 for no limit
+	Logger         *slog.Logger // logger for collection errors, the default logger if not given
+
+	MaxSeries           int    // maximum number of series of the metric definitions per collection, 0 for no limit
+	MaxSeriesPerMetric  int    // maximum number of series of metrics without their own limit, 0 for no limit
+	SeriesLimitPolicy   string // policy of metrics without their own, truncate if empty
+	MaxLabelValueLength int    // maximum length of label values in bytes, 0 for no limit
+
+	Middlewares []upnp.Middleware // further middlewares for the requests to the FRITZ!Box
+
+	loadLock sync.Mutex // serializes loading the services on demand
 
-	sync.Mutex // protects Root
-	Root       *upnp.Root
+	sync.Mutex     // protects Root, invalidMetrics, unsupported, sem, polling and dedup
+	Root           *upnp.Root
+	invalidMetrics int                     // number of metric definitions not matching the services
+	unsupported    map[actionKey]time.Time // actions the FRITZ!Box does not support, until they are called again
+	sem            chan struct{}
+	polling        *poller
+	dedup          *dedupState // messages of the scrapes logged recently
+
+	soap *soapMetrics // SOAP metrics served with the metrics of the collector, defaultSoapMetrics if nil
 }
 
 // simple ResponseWriter to collect output
@@ -126,42 +203,200 @@ func (w *TestResponseWriter) String() string {
 // LoadServices tries to load the service information. Retries until success.
 func (fc *FritzboxCollector) LoadServices() {
 	for {
-		root, err := upnp.LoadServices(fc.Url, fc.Username, fc.Password, fc.VerifyTls)
+		err := fc.loadServicesOnce(context.Background())
 		if err != nil {
-			fmt.Printf("cannot load services: %s\n", err)
+			fc.logger().Error("cannot load services", "err", err, "retry", serviceLoadRetryTime)
 
 			time.Sleep(serviceLoadRetryTime)
 			continue
 		}
 
-		fmt.Printf("services loaded\n")
-
-		fc.Lock()
-		fc.Root = root
-		fc.Unlock()
+		fc.logger().Info("services loaded")
 		return
 	}
 }
 
+// ensureServices loads the service information unless it is loaded already. Concurrent callers
+// wait for a single attempt instead of each loading the services.
+func (fc *FritzboxCollector) ensureServices(ctx context.Context) error {
+	fc.loadLock.Lock()
+	defer fc.loadLock.Unlock()
+
+	if fc.root() != nil {
+		return nil
+	}
+	return fc.loadServicesOnce(ctx)
+}
+
+// loadServicesOnce makes a single attempt to load the service information.
+func (fc *FritzboxCollector) loadServicesOnce(ctx context.Context) error {
+	options := []upnp.Option{
+		upnp.WithLogger(fc.logger()),
+		upnp.WithHooks(soapHooks{metrics: fc.soapMetrics()}),
+		upnp.WithMiddleware(upnp.LoggingMiddleware(fc.logger())),
+	}
+	if fc.RateLimit > 0 {
+		options = append(options, upnp.WithMiddleware(upnp.RateLimitMiddleware(fc.RateLimit, fc.maxConcurrency())))
+	}
+	if len(fc.Middlewares) > 0 {
+		options = append(options, upnp.WithMiddleware(fc.Middlewares...))
+	}
+	if !fc.VerifyTls {
+		options = append(options, upnp.WithInsecureSkipVerify())
+	}
+	if fc.CAFile != "" {
+		options = append(options, upnp.WithCAFile(fc.CAFile))
+	}
+	if fc.ProxyUrl != "" {
+		options = append(options, upnp.WithProxy(fc.ProxyUrl))
+	}
+	if fc.Timeout > 0 {
+		options = append(options, upnp.WithTimeout(fc.Timeout))
+	}
+
+	root, err := upnp.NewRoot(fc.Url, fc.Username, fc.Password, options...)
+	if err != nil {
+		return err
+	}
+
+	err = root.LoadContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	invalid := checkMetrics(fc.logger(), root, fc.metrics())
+
+	fc.Lock()
+	fc.Root = root
+	fc.invalidMetrics = invalid
+	// a firmware update may add actions
+	fc.unsupported = make(map[actionKey]time.Time)
+	fc.Unlock()
+	return nil
+}
+
+// root returns the loaded service tree or nil if the services are not loaded yet.
+func (fc *FritzboxCollector) root() *upnp.Root {
+	fc.Lock()
+	defer fc.Unlock()
+	return fc.Root
+}
+
+// soapMetrics returns the metrics recording the calls of actions.
+func (fc *FritzboxCollector) soapMetrics() *soapMetrics {
+	if fc.soap == nil {
+		return defaultSoapMetrics
+	}
+	return fc.soap
+}
+
+// logger returns the logger of the collector.
+func (fc *FritzboxCollector) logger() *slog.Logger {
+	if fc.Logger == nil {
+		return slog.Default()
+	}
+	return fc.Logger
+}
+
+// logDedup returns the state suppressing the messages repeated by the scrapes.
+func (fc *FritzboxCollector) logDedup() *dedupState {
+	fc.Lock()
+	defer fc.Unlock()
+
+	if fc.dedup == nil {
+		fc.dedup = newDedupState(logDedupInterval)
+	}
+	return fc.dedup
+}
+
+// metrics returns the current metric definitions.
+func (fc *FritzboxCollector) metrics() []*Metric {
+	fc.Lock()
+	defer fc.Unlock()
+	return fc.Metrics
+}
+
+// SetMetrics replaces the metric definitions used by Describe and Collect.
+// Scrapes already running finish with the old definitions.
+func (fc *FritzboxCollector) SetMetrics(metrics []*Metric) {
+	root := fc.root()
+
+	invalid := 0
+	if root != nil {
+		invalid = checkMetrics(fc.logger(), root, metrics)
+	}
+
+	fc.Lock()
+	fc.Metrics = metrics
+	fc.invalidMetrics = invalid
+	p := fc.polling
+	fc.Unlock()
+
+	if p != nil {
+		// restart polling with the new definitions
+		fc.StartPolling(p.defaultInterval)
+	}
+}
+
 func (fc *FritzboxCollector) Describe(ch chan<- *prometheus.Desc) {
-	for _, m := range metrics {
+	for _, m := range fc.metrics() {
 		ch <- m.Desc
 	}
+	ch <- actionTimedOutDesc
+	ch <- cacheAgeDesc
+	ch <- invalidMetricsDesc
+	ch <- actionUnsupportedDesc
+	ch <- upDesc
+	ch <- soapCallsDesc
+	ch <- scrapeDurationDesc
+	ch <- authBlockedUntilDesc
 }
 
-func (fc *FritzboxCollector) ReportMetric(ch chan<- prometheus.Metric, m *Metric, result upnp.Result) {
+// ReportMetric adds the series of the result to the guard. Labels found in extraLabels are not taken from the result.
+func (fc *FritzboxCollector) ReportMetric(guard *seriesGuard, m *Metric, result upnp.Result, extraLabels map[string]string) {
+	if m.Kind == kindInfo {
+		// info metrics only carry labels
+		guard.add(prometheus.GaugeValue, 1, fc.metricLabels(guard.logger, m, result, extraLabels))
+		return
+	}
 
 	val, ok := result[m.Result]
 	if !ok {
-		fmt.Printf("%s.%s has no result %s", m.Service, m.Action, m.Result)
-		collectErrors.Inc()
+		guard.logger.Error("missing result", "metric", m.PromDesc.FqName, "service", m.Service, "action", m.Action, "result", m.Result)
+		countError(m.Service, m.Action, errMissingResult)
 		return
 	}
 
+	if m.Kind == kindStateSet {
+		fc.reportStateSet(guard, m, result, extraLabels, fmt.Sprintf("%v", val))
+		return
+	}
+
+	floatval, ok := fc.metricValue(guard.logger, m, val)
+	if !ok {
+		return
+	}
+
+	guard.add(m.MetricType, floatval, fc.metricLabels(guard.logger, m, result, extraLabels))
+}
+
+// metricValue converts the result into the value of the metric. Errors are logged and counted.
+func (fc *FritzboxCollector) metricValue(logger *slog.Logger, m *Metric, val interface{}) (float64, bool) {
+	val, err := m.transform(val)
+	if err != nil {
+		logger.Error("cannot transform result", "metric", m.PromDesc.FqName, "service", m.Service, "action", m.Action, "result", m.Result, "err", err)
+		countError(m.Service, m.Action, errTypeMismatch)
+		return 0, false
+	}
+
 	var floatval float64
 	switch tval := val.(type) {
 	case uint64:
 		floatval = float64(tval)
+	case int64:
+		floatval = float64(tval)
+	case float64:
+		floatval = tval
 	case bool:
 		if tval {
 			floatval = 1
@@ -175,152 +410,691 @@ func (fc *FritzboxCollector) ReportMetric(ch chan<- prometheus.Metric, m *Metric
 			floatval = 0
 		}
 	default:
-		fmt.Println("unknown type", val)
-		collectErrors.Inc()
+		logger.Error("unknown type of result", "metric", m.PromDesc.FqName, "service", m.Service, "action", m.Action, "result", m.Result, "type", fmt.Sprintf("%T", val))
+		countError(m.Service, m.Action, errTypeMismatch)
+		return 0, false
+	}
+
+	return floatval, true
+}
+
+// reportResult adds the series of the result to the guard or the result to the aggregation of the
+// metric, if the result passes the filters of the metric.
+func (fc *FritzboxCollector) reportResult(guard *seriesGuard, m *Metric, agg *aggregation, result upnp.Result, extraLabels map[string]string) {
+	ok, err := m.filter(result)
+	if err != nil {
+		guard.logger.Error("cannot filter result", "metric", m.PromDesc.FqName, "service", m.Service, "action", m.Action, "err", err)
+		countError(m.Service, m.Action, err)
+		return
+	}
+	if !ok {
+		if agg != nil && m.Aggregate == aggregateCount {
+			// the count of the labels of filtered results is 0 instead of vanishing
+			agg.addEmpty(fc.metricLabels(guard.logger, m, result, extraLabels))
+		}
 		return
 	}
 
+	if agg == nil {
+		fc.ReportMetric(guard, m, result, extraLabels)
+		return
+	}
+
+	var value float64
+	if m.Aggregate != aggregateCount {
+		val, ok := result[m.Result]
+		if !ok {
+			guard.logger.Error("missing result", "metric", m.PromDesc.FqName, "service", m.Service, "action", m.Action, "result", m.Result)
+			countError(m.Service, m.Action, errMissingResult)
+			return
+		}
+
+		value, ok = fc.metricValue(guard.logger, m, val)
+		if !ok {
+			return
+		}
+	}
+
+	agg.add(fc.metricLabels(guard.logger, m, result, extraLabels), value)
+}
+
+// reportStateSet adds a series for each possible state of the result with 1 for the current state.
+func (fc *FritzboxCollector) reportStateSet(guard *seriesGuard, m *Metric, result upnp.Result, extraLabels map[string]string, current string) {
+	labels := append(fc.metricLabels(guard.logger, m, result, extraLabels), "")
+	stateIndex := len(labels) - 1
+
+	states := fc.states(m)
+
+	found := false
+	for _, state := range states {
+		var floatval float64
+		if state == current {
+			floatval = 1
+			found = true
+		}
+
+		labels[stateIndex] = state
+		guard.add(prometheus.GaugeValue, floatval, append([]string{}, labels...))
+	}
+
+	// always report the current state, even if it is not in the list of known states
+	if !found {
+		labels[stateIndex] = current
+		guard.add(prometheus.GaugeValue, 1, labels)
+	}
+}
+
+// states returns the possible states of a stateset metric. If none are configured,
+// the allowed values of the state variable from the service description are used.
+func (fc *FritzboxCollector) states(m *Metric) []string {
+	if len(m.States) > 0 {
+		return m.States
+	}
+
+	root := fc.root()
+	if root == nil {
+		return nil
+	}
+
+	// the services matching a pattern share the same description
+	for _, serviceType := range matchServices(root, m.Service) {
+		service, ok := root.Services[serviceType]
+		if !ok {
+			continue
+		}
+
+		for _, sv := range service.StateVariables {
+			if sv.Name == m.Result {
+				return sv.AllowedValues
+			}
+		}
+	}
+
+	return nil
+}
+
+// extraLabels returns the labels of a metric which are not taken from the results of an action: the
+// built-in labels, including the given device labels, and the labels of the service instance.
+func (fc *FritzboxCollector) extraLabels(m *Metric, serviceType string, device map[string]string) map[string]string {
+	labels := map[string]string{
+		labelGateway:  fc.Gateway,
+		labelInstance: serviceInstance(serviceType),
+	}
+	for l, v := range device {
+		labels[l] = v
+	}
+
+	if m.InstanceLabel != "" || m.InstanceNameLabel != "" {
+		instance := serviceInstance(serviceType)
+
+		if m.InstanceLabel != "" {
+			labels[m.InstanceLabel] = instance
+		}
+
+		if m.InstanceNameLabel != "" {
+			name, ok := m.InstanceNames[instance]
+			if !ok {
+				name = instance
+			}
+			labels[m.InstanceNameLabel] = name
+		}
+	}
+
+	return labels
+}
+
+// deviceLabels returns the labels taken from the device information of the FRITZ!Box. The values are
+// empty if the information is not available.
+func (fc *FritzboxCollector) deviceLabels(sc *scrape) map[string]string {
+	labels := map[string]string{
+		labelModel:    sc.root.Device.ModelName,
+		labelSerial:   "",
+		labelFirmware: "",
+	}
+
+	result, err := fc.GetActionResult(sc, deviceInfoService, deviceInfoAction)
+	if err != nil {
+		sc.logError("cannot get device information", actionCall{service: deviceInfoService, action: deviceInfoAction}, err)
+		return labels
+	}
+
+	for l, name := range map[string]string{labelModel: "ModelName", labelSerial: "SerialNumber", labelFirmware: "SoftwareVersion"} {
+		if v, ok := result[name]; ok {
+			labels[l] = fmt.Sprintf("%v", v)
+		}
+	}
+
+	return labels
+}
+
+// metricLabels returns the values of the variable labels of the metric.
+func (fc *FritzboxCollector) metricLabels(logger *slog.Logger, m *Metric, result upnp.Result, extraLabels map[string]string) []string {
 	labels := make([]string, len(m.PromDesc.VarLabels))
 	for i, l := range m.PromDesc.VarLabels {
-		if l == "gateway" {
-			labels[i] = fc.Gateway
+		if lval, ok := extraLabels[l]; ok {
+			labels[i] = m.labelValue(l, lval)
 		} else {
 			lval, ok := result[l]
 			if !ok {
-				fmt.Printf("%s.%s has no resul for label %s", m.Service, m.Action, l)
+				logger.Warn("missing result for label", "metric", m.PromDesc.FqName, "service", m.Service, "action", m.Action, "label", l)
 				lval = ""
 			}
 
-			// convert to lower to avoid problems with labels like hostname
-			labels[i] = strings.ToLower(fmt.Sprintf("%v", lval))
+			labels[i] = m.labelValue(l, fmt.Sprintf("%v", lval))
 		}
 	}
 
-	ch <- prometheus.MustNewConstMetric(
-		m.Desc,
-		m.MetricType,
-		floatval,
-		labels...)
+	return labels
 }
 
-func (fc *FritzboxCollector) GetActionResult(resultMap map[string]upnp.Result, serviceType string, actionName string, actionArg *upnp.ActionArgument) (upnp.Result, error) {
+func (fc *FritzboxCollector) GetActionResult(sc *scrape, serviceType string, actionName string, actionArgs ...*upnp.ActionArgument) (upnp.Result, error) {
+	return fc.callResult(sc, actionCall{service: serviceType, action: actionName, args: actionArgs})
+}
 
-	mKey := serviceType + "|" + actionName
+// callResult returns the cached outcome of the call or calls the action and caches the outcome.
+func (fc *FritzboxCollector) callResult(sc *scrape, call actionCall) (upnp.Result, error) {
+	if entry, ok := sc.cached(call.key()); ok {
+		return entry.result, entry.err
+	}
 
-	// for calls with argument also add arguement name and value to key
-	if actionArg != nil {
+	result, err := fc.callAction(sc, call)
+	sc.store(call, result, err)
 
-		mKey += "|" + actionArg.Name + "|" + fmt.Sprintf("%v", actionArg.Value)
+	return result, err
+}
+
+// callAction calls the action without consulting the result cache.
+func (fc *FritzboxCollector) callAction(sc *scrape, call actionCall) (upnp.Result, error) {
+	service, ok := sc.root.Services[call.service]
+	if !ok {
+		return nil, fmt.Errorf("%w: service %s not found", errUnknownAction, call.service)
 	}
 
-	lastResult := resultMap[mKey]
-	if lastResult == nil {
-		service, ok := fc.Root.Services[serviceType]
-		if !ok {
-			return nil, errors.New(fmt.Sprintf("service %s not found", serviceType))
+	action, ok := service.Actions[call.action]
+	if !ok {
+		return nil, fmt.Errorf("%w: action %s not found in service %s", errUnknownAction, call.action, call.service)
+	}
+
+	key := actionKey{call.service, call.action}
+	if fc.isUnsupported(key) {
+		return nil, fmt.Errorf("%w: %s.%s", errSkippedUnsupported, call.service, call.action)
+	}
+
+	release, err := fc.acquire(sc, call)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	result, err := action.CallContext(sc.ctx, call.args...)
+	if err != nil && sc.ctx.Err() != nil {
+		sc.markTimedOut(call)
+	}
+	sc.recordCall(err)
+	sc.countSoapCall()
+
+	if errors.Is(err, upnp.ErrActionNotSupported) {
+		sc.logger.Warn("action not supported by the FRITZ!Box, calling it again later", "service", call.service, "action", call.action, "retry", unsupportedRetryTime, "err", err)
+		fc.markUnsupported(key)
+	}
+
+	return result, err
+}
+
+// isUnsupported returns true if the FRITZ!Box did not support the action recently.
+func (fc *FritzboxCollector) isUnsupported(key actionKey) bool {
+	fc.Lock()
+	defer fc.Unlock()
+
+	until, ok := fc.unsupported[key]
+	if ok && !time.Now().Before(until) {
+		delete(fc.unsupported, key)
+		return false
+	}
+	return ok
+}
+
+// markUnsupported skips the action until unsupportedRetryTime passed.
+func (fc *FritzboxCollector) markUnsupported(key actionKey) {
+	fc.Lock()
+	defer fc.Unlock()
+	if fc.unsupported == nil {
+		fc.unsupported = make(map[actionKey]time.Time)
+	}
+	fc.unsupported[key] = time.Now().Add(unsupportedRetryTime)
+}
+
+// reportUnsupported sends a metric for each action the FRITZ!Box did not support recently.
+func (fc *FritzboxCollector) reportUnsupported(ch chan<- prometheus.Metric) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	now := time.Now()
+	for key, until := range fc.unsupported {
+		if now.Before(until) {
+			ch <- prometheus.MustNewConstMetric(actionUnsupportedDesc, prometheus.GaugeValue, 1, key.service, key.action)
 		}
+	}
+}
+
+// acquire waits until another request to the FRITZ!Box may be made. The returned function has to be
+// called once the request is done.
+func (fc *FritzboxCollector) acquire(sc *scrape, call actionCall) (func(), error) {
+	// limit the number of concurrent calls to the FRITZ!Box
+	sem := fc.semaphore()
+	select {
+	case sem <- struct{}{}:
+	case <-sc.ctx.Done():
+		// no need to call the action once the scrape timed out
+		sc.markTimedOut(call)
+		return nil, sc.ctx.Err()
+	}
+
+	return func() { <-sem }, nil
+}
+
+// GetListResult returns the entries of the list whose path is returned by the call.
+func (fc *FritzboxCollector) GetListResult(sc *scrape, call actionCall, pathResult string) ([]upnp.Result, error) {
+	result, err := fc.callResult(sc, call)
+	if err != nil {
+		return nil, err
+	}
+
+	key := "list|" + call.key() + "|" + pathResult
+	if entry, ok := sc.cached(key); ok {
+		return entry.list, entry.err
+	}
+
+	list, err := fc.getList(sc, call, result, pathResult)
+	sc.storeList(key, call, list, err)
+
+	return list, err
+}
+
+// getList downloads the list whose path is returned by the call.
+func (fc *FritzboxCollector) getList(sc *scrape, call actionCall, result upnp.Result, pathResult string) ([]upnp.Result, error) {
+	pathVal, ok := result[pathResult]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s.%s has no result %s", errMissingResult, call.service, call.action, pathResult)
+	}
 
-		action, ok := service.Actions[actionName]
+	release, err := fc.acquire(sc, call)
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := sc.root.GetListContext(sc.ctx, fmt.Sprintf("%v", pathVal))
+	release()
+
+	if err != nil && sc.ctx.Err() != nil {
+		sc.markTimedOut(call)
+	}
+	sc.recordCall(err)
+
+	return list, err
+}
+
+// semaphore returns the channel limiting the number of concurrent calls to the FRITZ!Box.
+func (fc *FritzboxCollector) semaphore() chan struct{} {
+	fc.Lock()
+	defer fc.Unlock()
+
+	if fc.sem == nil {
+		fc.sem = make(chan struct{}, fc.maxConcurrency())
+	}
+
+	return fc.sem
+}
+
+func (fc *FritzboxCollector) maxConcurrency() int {
+	if fc.MaxConcurrency < 1 {
+		return 1
+	}
+	return fc.MaxConcurrency
+}
+
+// callAll calls all given actions which are not yet cached in parallel and caches the results.
+// Each action is called only once, even if it is given multiple times.
+func (fc *FritzboxCollector) callAll(sc *scrape, calls []actionCall) {
+	seen := make(map[string]bool)
+	jobs := make(chan actionCall, len(calls))
+	for _, call := range calls {
+		key := call.key()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		if _, ok := sc.cached(key); !ok {
+			jobs <- call
+		}
+	}
+	close(jobs)
+
+	var wg sync.WaitGroup
+	for i := 0; i < fc.maxConcurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for call := range jobs {
+				result, err := fc.callAction(sc, call)
+				sc.store(call, result, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// expandCalls adds the argument to the calls of the metric, one call for each of its values. The results
+// of the provider actions have to be cached already.
+func (fc *FritzboxCollector) expandCalls(sc *scrape, m *Metric, aa *ActionArg, calls []actionCall) []actionCall {
+	var expanded []actionCall
+	for _, call := range calls {
+		values, labels, ok := fc.argumentValues(sc, m, aa, call)
 		if !ok {
-			return nil, errors.New(fmt.Sprintf("action %s not found in service %s", actionName, serviceType))
+			continue
 		}
 
-		var err error
-		lastResult, err = action.Call(actionArg)
+		for _, value := range values {
+			next := actionCall{
+				service: call.service,
+				action:  call.action,
+				args:    append(append([]*upnp.ActionArgument{}, call.args...), &upnp.ActionArgument{Name: aa.Name, Value: value}),
+				labels:  make(map[string]string),
+				indexed: call.indexed || aa.IsIndex,
+			}
+			for l, v := range call.labels {
+				next.labels[l] = v
+			}
+			for l, v := range labels {
+				next.labels[l] = v
+			}
+			if aa.Label != "" {
+				next.labels[aa.Label] = fmt.Sprintf("%v", value)
+			}
+
+			expanded = append(expanded, next)
+		}
+	}
+
+	return expanded
+}
+
+// providerCall returns the call of the provider action of the argument for the given call of the
+// metric, which contains the values of the previous arguments.
+func (aa *ActionArg) providerCall(call actionCall) (actionCall, bool) {
+	if aa.ProviderAction == "" {
+		return actionCall{}, false
+	}
+
+	provider := actionCall{service: call.service, action: aa.ProviderAction, indexed: call.indexed}
+	for _, pa := range aa.ProviderArguments {
+		var value interface{}
+		value = pa.Value
+
+		if pa.Argument != "" {
+			for _, arg := range call.args {
+				if arg.Name == pa.Argument {
+					value = arg.Value
+				}
+			}
+		}
+
+		provider.args = append(provider.args, &upnp.ActionArgument{Name: pa.Name, Value: value})
+	}
+
+	return provider, true
+}
+
+// argumentValues returns the values of the argument for the call of the metric: the given value, the
+// result of the provider action or, for an index, all numbers below that result. Also returns the
+// labels taken from the results of the provider action. Errors are collected and false is returned.
+func (fc *FritzboxCollector) argumentValues(sc *scrape, m *Metric, aa *ActionArg, call actionCall) ([]interface{}, map[string]string, bool) {
+	var value interface{}
+	value = aa.Value
+	labels := make(map[string]string)
+
+	provider, ok := aa.providerCall(call)
+	if ok {
+		provRes, err := fc.callResult(sc, provider)
 
 		if err != nil {
-			return nil, err
+			if provider.vanished(err) {
+				// the number of entries of an outer loop shrank since its provider action was called
+				sc.logger.Debug("entry vanished", append(provider.logArgs(), "metric", m.PromDesc.FqName, "err", err)...)
+				return nil, nil, false
+			}
+
+			sc.logError("cannot call provider action", provider, err, "metric", m.PromDesc.FqName)
+			return nil, nil, false
+		}
+
+		value, ok = provRes[aa.Value] // Value contains the result name for provider actions
+		if !ok {
+			err := fmt.Errorf("%w: provider action has no result %s", errMissingResult, aa.Value)
+			sc.collectError("missing result of provider action", provider, err, "metric", m.PromDesc.FqName)
+			return nil, nil, false
 		}
 
-		resultMap[mKey] = lastResult
+		for l, name := range aa.ResultLabels {
+			lval, ok := provRes[name]
+			if !ok {
+				sc.logger.Warn("missing result for label", "metric", m.PromDesc.FqName, "service", provider.service, "action", provider.action, "label", l)
+				lval = ""
+			}
+
+			labels[l] = fmt.Sprintf("%v", lval)
+		}
 	}
 
-	return lastResult, nil
+	if !aa.IsIndex {
+		return []interface{}{value}, labels, true
+	}
+
+	sval := fmt.Sprintf("%v", value)
+	count, err := strconv.Atoi(sval)
+	if err != nil {
+		err = fmt.Errorf("%w: invalid number of entries: %s", errTypeMismatch, err)
+		sc.collectError("invalid number of entries", provider, err, "metric", m.PromDesc.FqName)
+		return nil, nil, false
+	}
+
+	values := make([]interface{}, count)
+	for i := range values {
+		values[i] = i
+	}
+
+	return values, labels, true
 }
 
 func (fc *FritzboxCollector) Collect(ch chan<- prometheus.Metric) {
-	fc.Lock()
-	root := fc.Root
-	fc.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), *flagScrapeTimeout)
+	defer cancel()
+
+	fc.CollectContext(ctx, ch)
+}
+
+// CollectContext collects the metrics until the context is done. Actions which did not complete in time
+// are reported by the action timed out metric.
+func (fc *FritzboxCollector) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	start := time.Now()
+
+	up, calls := fc.collectUp(ctx, ch)
+	fc.reportUnsupported(ch)
+	fc.reportAuth(ch)
 
+	var upValue float64
+	if up {
+		upValue = 1
+	}
+	ch <- prometheus.MustNewConstMetric(upDesc, prometheus.GaugeValue, upValue)
+	ch <- prometheus.MustNewConstMetric(soapCallsDesc, prometheus.GaugeValue, float64(calls))
+	ch <- prometheus.MustNewConstMetric(scrapeDurationDesc, prometheus.GaugeValue, time.Since(start).Seconds())
+}
+
+// reportAuth reports until when no credentials are sent, since the FRITZ!Box rejected them.
+func (fc *FritzboxCollector) reportAuth(ch chan<- prometheus.Metric) {
+	root := fc.root()
 	if root == nil {
-		// Services not loaded yet
 		return
 	}
 
-	// create a map for caching results
-	var resultMap = make(map[string]upnp.Result)
+	var until float64
+	if _, blockedUntil := root.AuthState(); time.Now().Before(blockedUntil) {
+		until = float64(blockedUntil.UnixNano()) / 1e9
+	}
+	ch <- prometheus.MustNewConstMetric(authBlockedUntilDesc, prometheus.GaugeValue, until)
+}
 
-	for _, m := range metrics {
-		var actArg *upnp.ActionArgument
-		if m.ActionArgument != nil {
-			aa := m.ActionArgument
-			var value interface{}
-			value = aa.Value
+// collectUp collects the metrics and returns whether the FRITZ!Box is up and the number of actions called.
+func (fc *FritzboxCollector) collectUp(ctx context.Context, ch chan<- prometheus.Metric) (bool, int) {
+	root := fc.root()
+	if root == nil {
+		// Services not loaded yet
+		return false, 0
+	}
 
-			if aa.ProviderAction != "" {
-				provRes, err := fc.GetActionResult(resultMap, m.Service, aa.ProviderAction, nil)
+	fc.Lock()
+	invalid := fc.invalidMetrics
+	fc.Unlock()
+	ch <- prometheus.MustNewConstMetric(invalidMetricsDesc, prometheus.GaugeValue, float64(invalid))
 
-				if err != nil {
-					fmt.Printf("Error getting provider action %s result for %s.%s: %s\n", aa.ProviderAction, m.Service, m.Action, err.Error())
-					collectErrors.Inc()
-					continue
-				}
+	if p := fc.activePoller(); p != nil {
+		// serve the results of the background polling
+		return p.collect(ch)
+	}
 
-				var ok bool
-				value, ok = provRes[aa.Value] // Value contains the result name for provider actions
-				if !ok {
-					fmt.Printf("provider action %s for %s.%s has no result", m.Service, m.Action, aa.Value)
-					collectErrors.Inc()
-					continue
+	budget := newSeriesBudget(fc.MaxSeries)
+	sc := fc.collectMetrics(ctx, root, fc.metrics(), ch, budget)
+	budget.report(sc.logger)
+	sc.reportTimeouts(ch)
+
+	return sc.up(), sc.soapCalls()
+}
+
+// collectMetrics collects the given metrics until the context is done. The global series limit is
+// applied with the budget, if not nil. The returned scrape contains the actions that timed out.
+func (fc *FritzboxCollector) collectMetrics(ctx context.Context, root *upnp.Root, metrics []*Metric, ch chan<- prometheus.Metric, budget *seriesBudget) *scrape {
+	sc := newScrape(ctx, root, fc.logger(), fc.logDedup())
+
+	// expand service patterns to the matching services
+	services := make([][]string, len(metrics))
+	for i, m := range metrics {
+		services[i] = matchServices(root, m.Service)
+	}
+
+	// add the arguments one after the other to the calls, since the calls of indexed metrics depend on
+	// the results of the provider actions, whose arguments may depend on the previous arguments. The
+	// provider actions of all metrics are called in parallel for each argument position.
+	calls := make([][]actionCall, len(metrics))
+	positions := 0
+	for i, m := range metrics {
+		for _, service := range services[i] {
+			calls[i] = append(calls[i], actionCall{service: service, action: m.Action})
+		}
+		positions = max(positions, len(m.ActionArguments))
+	}
+
+	for pos := 0; pos < positions; pos++ {
+		var providerCalls []actionCall
+		for i, m := range metrics {
+			if pos >= len(m.ActionArguments) {
+				continue
+			}
+			for _, call := range calls[i] {
+				if provider, ok := m.ActionArguments[pos].providerCall(call); ok {
+					providerCalls = append(providerCalls, provider)
 				}
 			}
+		}
+		fc.callAll(sc, providerCalls)
+
+		for i, m := range metrics {
+			if pos < len(m.ActionArguments) {
+				calls[i] = fc.expandCalls(sc, m, m.ActionArguments[pos], calls[i])
+			}
+		}
+	}
+
+	var allCalls []actionCall
+	for i := range metrics {
+		allCalls = append(allCalls, calls[i]...)
+	}
+	needDevice := usesDeviceLabels(metrics)
+	if needDevice {
+		allCalls = append(allCalls, actionCall{service: deviceInfoService, action: deviceInfoAction})
+	}
+	fc.callAll(sc, allCalls)
+
+	var device map[string]string
+	if needDevice {
+		device = fc.deviceLabels(sc)
+	}
+
+	// all results are cached now, so report them in the order of the metric definitions
+	guard := newSeriesGuard(fc, ch, sc.logger, budget)
+	for i, m := range metrics {
+		var agg *aggregation
+		if m.Aggregate != "" {
+			agg = newAggregation(m)
+		}
+
+		for _, call := range calls[i] {
+			extraLabels := fc.extraLabels(m, call.service, device)
+			for l, v := range call.labels {
+				extraLabels[l] = v
+			}
+
+			if m.Source == sourceList {
+				list, err := fc.GetListResult(sc, call, m.ListPath)
 
-			if aa.IsIndex {
-				sval := fmt.Sprintf("%v", value)
-				count, err := strconv.Atoi(sval)
 				if err != nil {
-					fmt.Println(err.Error())
-					collectErrors.Inc()
+					sc.logError("cannot get list", call, err, "metric", m.PromDesc.FqName)
 					continue
 				}
 
-				for i := 0; i < count; i++ {
-					actArg = &upnp.ActionArgument{Name: aa.Name, Value: i}
-					result, err := fc.GetActionResult(resultMap, m.Service, m.Action, actArg)
+				if agg != nil && m.Aggregate == aggregateCount && !hasResultLabels(m) {
+					// the count of an empty list is 0, if the labels are known without results
+					agg.addEmpty(fc.metricLabels(sc.logger, m, nil, extraLabels))
+				}
+				for _, item := range list {
+					fc.reportResult(guard, m, agg, item, extraLabels)
+				}
+				continue
+			}
 
-					if err != nil {
-						fmt.Println(err.Error())
-						collectErrors.Inc()
-						continue
-					}
+			result, err := fc.callResult(sc, call)
 
-					fc.ReportMetric(ch, m, result)
+			if err != nil {
+				if call.vanished(err) {
+					// the number of entries shrank since the provider action was called
+					sc.logger.Debug("entry vanished", append(call.logArgs(), "metric", m.PromDesc.FqName, "err", err)...)
+					continue
 				}
 
+				sc.logError("cannot call action", call, err, "metric", m.PromDesc.FqName)
 				continue
-			} else {
-				actArg = &upnp.ActionArgument{Name: aa.Name, Value: value}
 			}
-		}
 
-		result, err := fc.GetActionResult(resultMap, m.Service, m.Action, actArg)
-
-		if err != nil {
-			fmt.Println(err.Error())
-			collectErrors.Inc()
-			continue
+			fc.reportResult(guard, m, agg, result, extraLabels)
 		}
 
-		fc.ReportMetric(ch, m, result)
+		if agg != nil {
+			agg.report(guard)
+		}
+		guard.flush(m)
 	}
+	sc.flushLog()
+
+	return sc
 }
 
-func test() {
-	root, err := upnp.LoadServices(*flagGatewayUrl, *flagGatewayUsername, *flagGatewayPassword, *flagGatewayVerifyTLS)
+func test(fc *FritzboxCollector) {
+	err := fc.loadServicesOnce(context.Background())
 	if err != nil {
 		panic(err)
 	}
+	root := fc.root()
 
 	var newEntry bool = false
 	var json bytes.Buffer
@@ -373,7 +1147,7 @@ func test() {
 			}
 
 			fmt.Printf("  %s - calling - results: variable: value\n", a.Name)
-			res, err := a.Call(nil)
+			res, err := a.Call()
 
 			if err != nil {
 				fmt.Printf("    FAILED:%s\n", err.Error())
@@ -409,67 +1183,244 @@ func getValueType(vt string) prometheus.ValueType {
 	return prometheus.UntypedValue
 }
 
+// loadMetrics reads the metric definitions from a JSON file and initializes them with the external labels.
+func loadMetrics(file string, externalLabels map[string]string) ([]*Metric, error) {
+	jsonData, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading metric file: %s", err)
+	}
+
+	return parseMetrics(jsonData, externalLabels)
+}
+
+// parseMetrics parses the metric definitions and initializes them. The external labels are added
+// to all metrics.
+func parseMetrics(jsonData []byte, externalLabels map[string]string) ([]*Metric, error) {
+	var metrics []*Metric
+	err := json.Unmarshal(jsonData, &metrics)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing JSON: %s", err)
+	}
+
+	// init metrics
+	for _, m := range metrics {
+		pd := m.PromDesc
+
+		switch m.Kind {
+		case "", kindInfo, kindStateSet:
+		default:
+			return nil, fmt.Errorf("unknown kind %s of %s", m.Kind, pd.FqName)
+		}
+
+		labels, constLabels, err := m.initLabels(externalLabels)
+		if err != nil {
+			return nil, fmt.Errorf("invalid labels of %s: %s", pd.FqName, err)
+		}
+
+		m.Desc = prometheus.NewDesc(pd.FqName, pd.Help, labels, constLabels)
+		m.MetricType = getValueType(m.PromType)
+
+		for _, t := range m.Transforms {
+			err = t.init()
+			if err != nil {
+				return nil, fmt.Errorf("invalid transform of %s: %s", pd.FqName, err)
+			}
+		}
+
+		for _, f := range m.Filter {
+			err = f.init()
+			if err != nil {
+				return nil, fmt.Errorf("invalid filter of %s: %s", pd.FqName, err)
+			}
+		}
+
+		if m.SeriesLimitPolicy != "" && !validPolicy(m.SeriesLimitPolicy) {
+			return nil, fmt.Errorf("unknown series limit policy %s of %s", m.SeriesLimitPolicy, pd.FqName)
+		}
+
+		if m.Aggregate != "" {
+			if !validAggregate(m.Aggregate) {
+				return nil, fmt.Errorf("unknown aggregate %s of %s", m.Aggregate, pd.FqName)
+			}
+			if m.Kind != "" {
+				return nil, fmt.Errorf("%s metric %s cannot be aggregated", m.Kind, pd.FqName)
+			}
+		}
+
+		if m.Interval != "" {
+			m.PollInterval, err = time.ParseDuration(m.Interval)
+			if err != nil {
+				return nil, fmt.Errorf("invalid interval of %s: %s", pd.FqName, err)
+			}
+		}
+
+		if m.ActionArgument != nil {
+			m.ActionArguments = append([]*ActionArg{m.ActionArgument}, m.ActionArguments...)
+			m.ActionArgument = nil
+		}
+		names := make(map[string]bool)
+		for _, aa := range m.ActionArguments {
+			if aa == nil || aa.Name == "" {
+				return nil, fmt.Errorf("action argument without name in %s", pd.FqName)
+			}
+			for _, pa := range aa.ProviderArguments {
+				if pa == nil || pa.Name == "" {
+					return nil, fmt.Errorf("provider argument without name in %s", pd.FqName)
+				}
+				if pa.Argument != "" && !names[pa.Argument] {
+					return nil, fmt.Errorf("provider argument %s of %s refers to %s, which is no previous argument", pa.Name, pd.FqName, pa.Argument)
+				}
+			}
+			names[aa.Name] = true
+		}
+	}
+
+	return metrics, nil
+}
+
+// recordingMiddlewares returns the middlewares to record or replay the requests to the FRITZ!Box.
+func recordingMiddlewares() ([]upnp.Middleware, error) {
+	var middlewares []upnp.Middleware
+
+	if *flagRecordDir != "" && *flagReplayDir != "" {
+		return nil, errors.New("-record and -replay cannot be used together")
+	}
+
+	if *flagRecordDir != "" {
+		var elements []string
+		for _, e := range strings.Split(*flagRecordRedact, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				elements = append(elements, e)
+			}
+		}
+
+		record, err := upnp.RecordMiddleware(*flagRecordDir, elements)
+		if err != nil {
+			return nil, fmt.Errorf("cannot record: %s", err)
+		}
+		middlewares = append(middlewares, record)
+	}
+
+	if *flagReplayDir != "" {
+		replay, err := upnp.ReplayMiddleware(*flagReplayDir)
+		if err != nil {
+			return nil, fmt.Errorf("cannot replay: %s", err)
+		}
+		middlewares = append(middlewares, replay)
+	}
+
+	return middlewares, nil
+}
+
 func main() {
 	flag.Parse()
 
+	logger, err := newLogger(os.Stderr, *flagLogLevel, *flagLogFormat)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+
 	u, err := url.Parse(*flagGatewayUrl)
 	if err != nil {
 		fmt.Println("invalid URL:", err)
 		return
 	}
 
+	if !validPolicy(*flagSeriesLimitPolicy) {
+		fmt.Println("invalid series limit policy:", *flagSeriesLimitPolicy)
+		os.Exit(1)
+	}
+
+	collector := &FritzboxCollector{
+		Url:       *flagGatewayUrl,
+		Gateway:   u.Hostname(),
+		Username:  *flagGatewayUsername,
+		Password:  *flagGatewayPassword,
+		VerifyTls: *flagGatewayVerifyTLS,
+		CAFile:    *flagGatewayCAFile,
+		ProxyUrl:  *flagGatewayProxyUrl,
+		Timeout:   *flagGatewayTimeout,
+
+		MaxConcurrency: *flagMaxConcurrency,
+		RateLimit:      *flagRateLimit,
+		Logger:         logger.With("gateway", u.Hostname()),
+
+		MaxSeries:           *flagMaxSeries,
+		MaxSeriesPerMetric:  *flagMaxSeriesPerMetric,
+		SeriesLimitPolicy:   *flagSeriesLimitPolicy,
+		MaxLabelValueLength: *flagMaxLabelValueLength,
+	}
+
+	middlewares, err := recordingMiddlewares()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	collector.Middlewares = middlewares
+
 	if *flagTest {
-		test()
+		test(collector)
 		return
 	}
 
-	// read metrics
-	jsonData, err := ioutil.ReadFile(*flagMetricsFile)
+	externalLabels, err := parseExternalLabels(*flagExternalLabels)
 	if err != nil {
-		fmt.Println("error reading metric file:", err)
+		fmt.Println(err)
 		return
 	}
 
-	err = json.Unmarshal(jsonData, &metrics)
+	metrics, err := loadMetrics(*flagMetricsFile, externalLabels)
 	if err != nil {
-		fmt.Println("error parsing JSON:", err)
+		fmt.Println(err)
 		return
 	}
 
-	// init metrics
-	for _, m := range metrics {
-		pd := m.PromDesc
+	modules, err := loadModules(*flagModulesFile, externalLabels, &Module{
+		Username:    *flagGatewayUsername,
+		Password:    *flagGatewayPassword,
+		VerifyTls:   *flagGatewayVerifyTLS,
+		CAFile:      *flagGatewayCAFile,
+		ProxyUrl:    *flagGatewayProxyUrl,
+		MetricsFile: *flagMetricsFile,
+		metrics:     metrics,
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	collector.Metrics = metrics
 
-		// make labels lower case
-		labels := make([]string, len(pd.VarLabels))
-		for i, l := range pd.VarLabels {
-			labels[i] = strings.ToLower(l)
+	if *flagValidate {
+		err := collector.loadServicesOnce(context.Background())
+		if err != nil {
+			fmt.Println("cannot load services:", err)
+			os.Exit(1)
 		}
 
-		m.Desc = prometheus.NewDesc(pd.FqName, pd.Help, labels, nil)
-		m.MetricType = getValueType(m.PromType)
-	}
+		if invalid := countInvalid(collector.root(), metrics); invalid > 0 {
+			fmt.Printf("%d of %d metric definitions are invalid\n", invalid, len(metrics))
+			os.Exit(1)
+		}
 
-	collector := &FritzboxCollector{
-		Url:       *flagGatewayUrl,
-		Gateway:   u.Hostname(),
-		Username:  *flagGatewayUsername,
-		Password:  *flagGatewayPassword,
-		VerifyTls: *flagGatewayVerifyTLS,
+		fmt.Printf("all %d metric definitions are valid\n", len(metrics))
+		return
 	}
 
 	if *flagCollect {
 		collector.LoadServices()
 
-		prometheus.MustRegister(collector)
-		prometheus.MustRegister(collectErrors)
+		prometheus.MustRegister(collectErrors, droppedSeries)
+		prometheus.MustRegister(defaultSoapMetrics.collectors()...)
 
 		fmt.Println("collecting metrics via http")
 
 		// simulate HTTP request without starting actual http server
 		writer := TestResponseWriter{header: http.Header{}}
 		request := http.Request{}
-		promhttp.Handler().ServeHTTP(&writer, &request)
+		scrapeHandler(collector, prometheus.DefaultGatherer).ServeHTTP(&writer, &request)
 
 		fmt.Println(writer.String())
 
@@ -478,17 +1429,44 @@ func main() {
 
 	go collector.LoadServices()
 
-	prometheus.MustRegister(collector)
-	prometheus.MustRegister(collectErrors)
+	if *flagPollInterval > 0 {
+		collector.StartPolling(*flagPollInterval)
+	}
+
+	probeHandler := NewProbeHandler(modules)
+
+	reload := newReloader(externalLabels, metricsFiles(modules)...)
+	reload.OnReload(func(file string, metrics []*Metric) {
+		if file == *flagMetricsFile {
+			collector.SetMetrics(metrics)
+		}
+	})
+	reload.OnReload(probeHandler.SetMetrics)
+	go reload.Watch(*flagWatchInterval)
 
-	healthChecks := createHealthChecks(*flagGatewayUrl)
+	prometheus.MustRegister(collectErrors, droppedSeries)
+	prometheus.MustRegister(defaultSoapMetrics.collectors()...)
+	prometheus.MustRegister(reloadSuccess, reloadSuccessTime, reloads, configHash)
 
-	http.Handle("/metrics", promhttp.Handler())
-	fmt.Printf("metrics available at http://%s/metrics\n", *flagAddr)
+	maxGoroutines := *flagMaxGoroutines
+	if maxGoroutines <= 0 {
+		// the collector and the probe collectors may scrape at the same time
+		maxGoroutines = goroutineLimit(collector.maxConcurrency(), 1+maxProbeCollectors)
+	}
+	healthChecks := createHealthChecks(*flagGatewayUrl, collector, maxGoroutines)
+
+	http.Handle("/metrics", scrapeHandler(collector, prometheus.DefaultGatherer))
+	logger.Info("metrics available", "url", fmt.Sprintf("http://%s/metrics", *flagAddr))
+	http.Handle("/probe", probeHandler)
+	logger.Info("probe endpoint available", "url", fmt.Sprintf("http://%s/probe?target=<host>&module=<module>", *flagAddr))
+	http.Handle("/-/reload", reload)
+	logger.Info("reload the metric definitions with a POST request", "url", fmt.Sprintf("http://%s/-/reload", *flagAddr))
 	http.HandleFunc("/ready", healthChecks.ReadyEndpoint)
-	fmt.Printf("readyness check available at http://%s/ready\n", *flagAddr)
+	logger.Info("readyness check available", "url", fmt.Sprintf("http://%s/ready", *flagAddr))
 	http.HandleFunc("/live", healthChecks.LiveEndpoint)
-	fmt.Printf("liveness check available at http://%s/live\n", *flagAddr)
+	logger.Info("liveness check available", "url", fmt.Sprintf("http://%s/live", *flagAddr))
 
-	log.Fatal(http.ListenAndServe(*flagAddr, nil))
+	err = http.ListenAndServe(*flagAddr, nil)
+	logger.Error("cannot serve http", "err", err)
+	os.Exit(1)
 }
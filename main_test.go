@@ -0,0 +1,530 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	upnp "gitlab.com/dekarl/fritzbox_exporter/fritzbox_upnp"
+	"gitlab.com/dekarl/fritzbox_exporter/fritzbox_upnp/fake"
+)
+
+const hostsService = "urn:dslforum-org:service:Hosts:1"
+
+// metric definitions of the tests: an IGD action, a TR-064 action and an indexed TR-064 action
+const testMetrics = `[
+	{
+		"service": "urn:schemas-upnp-org:service:WANCommonInterfaceConfig:1",
+		"action": "GetTotalBytesSent",
+		"result": "TotalBytesSent",
+		"promDesc": {"fqName": "test_wan_bytes_sent", "help": "bytes sent", "varLabels": ["gateway"]},
+		"promType": "CounterValue"
+	},
+	{
+		"service": "urn:dslforum-org:service:DeviceInfo:1",
+		"action": "GetInfo",
+		"result": "UpTime",
+		"promDesc": {"fqName": "test_uptime_seconds", "help": "uptime", "varLabels": ["gateway"]},
+		"promType": "GaugeValue"
+	},
+	{
+		"service": "urn:dslforum-org:service:Hosts:1",
+		"action": "GetGenericHostEntry",
+		"actionArguments": [
+			{"name": "NewIndex", "isIndex": true, "providerAction": "GetHostNumberOfEntries", "value": "HostNumberOfEntries"}
+		],
+		"result": "Active",
+		"promDesc": {"fqName": "test_host_active", "help": "active hosts", "varLabels": ["HostName"]},
+		"promType": "GaugeValue"
+	}
+]`
+
+// startSimulator starts the simulator with the example scenario, changed by modify if not nil.
+func startSimulator(t *testing.T, modify func(sc *fake.Scenario)) (*fake.Server, *httptest.Server) {
+	t.Helper()
+
+	sc, err := fake.LoadScenario("fritzbox_upnp/fake/scenario.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.Latency = ""
+	if modify != nil {
+		modify(sc)
+	}
+
+	s, err := fake.NewServer(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := s.Start()
+	t.Cleanup(ts.Close)
+
+	return s, ts
+}
+
+// startCollector starts the simulator with the example scenario, changed by modify if not nil,
+// and returns a collector of the test metrics with loaded services.
+func startCollector(t *testing.T, password string, modify func(sc *fake.Scenario)) (*FritzboxCollector, *fake.Server) {
+	t.Helper()
+
+	s, ts := startSimulator(t, modify)
+
+	metrics, err := parseMetrics([]byte(testMetrics), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fc := &FritzboxCollector{
+		Url:            ts.URL,
+		Gateway:        "fritz.box",
+		Username:       "admin",
+		Password:       password,
+		Metrics:        metrics,
+		MaxConcurrency: 4,
+		Logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	if err := fc.loadServicesOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return fc, s
+}
+
+// scrapeMetrics scrapes the collector like Prometheus with the timeout header if not empty.
+func scrapeMetrics(t *testing.T, fc *FritzboxCollector, timeout string) map[string]*dto.MetricFamily {
+	t.Helper()
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	if timeout != "" {
+		req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", timeout)
+	}
+	rec := httptest.NewRecorder()
+	scrapeHandler(fc).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("scrape failed with status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return families
+}
+
+// value returns the value of the series with the labels and whether it was found.
+func value(families map[string]*dto.MetricFamily, name string, labels map[string]string) (float64, bool) {
+	family, ok := families[name]
+	if !ok {
+		return 0, false
+	}
+
+	for _, m := range family.Metric {
+		match := true
+		for l, v := range labels {
+			found := false
+			for _, pair := range m.Label {
+				if pair.GetName() == l && pair.GetValue() == v {
+					found = true
+				}
+			}
+			match = match && found
+		}
+		if !match {
+			continue
+		}
+
+		switch {
+		case m.Gauge != nil:
+			return m.Gauge.GetValue(), true
+		case m.Counter != nil:
+			return m.Counter.GetValue(), true
+		case m.Untyped != nil:
+			return m.Untyped.GetValue(), true
+		}
+	}
+	return 0, false
+}
+
+func expectValue(t *testing.T, families map[string]*dto.MetricFamily, name string, labels map[string]string, want float64) {
+	t.Helper()
+
+	v, ok := value(families, name, labels)
+	if !ok {
+		t.Errorf("%s%v not reported", name, labels)
+	} else if v != want {
+		t.Errorf("%s%v is %v, want %v", name, labels, v, want)
+	}
+}
+
+func expectMissing(t *testing.T, families map[string]*dto.MetricFamily, name string) {
+	t.Helper()
+
+	if _, ok := families[name]; ok {
+		t.Errorf("%s reported", name)
+	}
+}
+
+func TestCollectorScrape(t *testing.T) {
+	fc, s := startCollector(t, "secret", nil)
+
+	families := scrapeMetrics(t, fc, "")
+
+	expectValue(t, families, "fritzbox_up", nil, 1)
+	expectValue(t, families, "test_wan_bytes_sent", map[string]string{"gateway": "fritz.box"}, 1538445867)
+	expectValue(t, families, "test_uptime_seconds", map[string]string{"gateway": "fritz.box"}, 1814400)
+	expectValue(t, families, "test_host_active", map[string]string{"hostname": "laptop"}, 1)
+	expectValue(t, families, "test_host_active", map[string]string{"hostname": "phone"}, 0)
+	expectValue(t, families, "fritzbox_auth_blocked_until_timestamp_seconds", nil, 0)
+	expectMissing(t, families, "fritzbox_exporter_action_timed_out")
+
+	if n := len(families["test_host_active"].GetMetric()); n != 3 {
+		t.Errorf("%d hosts reported, want 3", n)
+	}
+	if n := s.Calls(hostsService, "GetHostNumberOfEntries"); n != 1 {
+		t.Errorf("provider action called %d times, want once", n)
+	}
+}
+
+func TestCollectorWrongPassword(t *testing.T) {
+	fc, _ := startCollector(t, "wrong", nil)
+
+	getInfoErrors := func() float64 {
+		return testutil.ToFloat64(collectErrors.WithLabelValues(deviceInfoService, "GetInfo", reasonUnauthorized, "401")) +
+			testutil.ToFloat64(collectErrors.WithLabelValues(deviceInfoService, "GetInfo", reasonAuthBlocked, "401"))
+	}
+	before := getInfoErrors()
+	families := scrapeMetrics(t, fc, "")
+
+	// the IGD service does not require authentication
+	expectValue(t, families, "fritzbox_up", nil, 1)
+	expectValue(t, families, "test_wan_bytes_sent", map[string]string{"gateway": "fritz.box"}, 1538445867)
+	expectMissing(t, families, "test_uptime_seconds")
+	expectMissing(t, families, "test_host_active")
+
+	if v, _ := value(families, "fritzbox_auth_blocked_until_timestamp_seconds", nil); v <= 0 {
+		t.Error("credentials not blocked")
+	}
+	if failures, _ := fc.root().AuthState(); failures != 1 {
+		t.Errorf("%d authentication failures, want 1", failures)
+	}
+
+	if n := getInfoErrors() - before; n != 1 {
+		t.Errorf("%v collection errors of GetInfo, want 1", n)
+	}
+}
+
+func TestCollectorStaleNonce(t *testing.T) {
+	fc, s := startCollector(t, "secret", func(sc *fake.Scenario) {
+		sc.NonceLifetime = "50ms"
+	})
+
+	scrapeMetrics(t, fc, "")
+	time.Sleep(100 * time.Millisecond)
+	families := scrapeMetrics(t, fc, "")
+
+	expectValue(t, families, "test_uptime_seconds", map[string]string{"gateway": "fritz.box"}, 1814400)
+	if n := len(families["test_host_active"].GetMetric()); n != 3 {
+		t.Errorf("%d hosts reported, want 3", n)
+	}
+	if failures, _ := fc.root().AuthState(); failures != 0 {
+		t.Errorf("%d authentication failures", failures)
+	}
+	if s.Challenges() < 2 {
+		t.Errorf("nonce never stale")
+	}
+}
+
+func TestCollectorSoapFault(t *testing.T) {
+	fc, _ := startCollector(t, "secret", func(sc *fake.Scenario) {
+		for _, svc := range sc.Services {
+			for _, a := range svc.Actions {
+				if svc.ServiceType == deviceInfoService && a.Name == "GetInfo" {
+					a.Fault = &fake.Fault{Code: upnp.UpnpInvalidAction, Description: "Invalid Action"}
+				}
+				if svc.ServiceType == hostsService && a.Name == "GetGenericHostEntry" {
+					a.Fault = &fake.Fault{Code: upnp.UpnpActionFailed, Description: "Action Failed"}
+				}
+			}
+		}
+	})
+
+	families := scrapeMetrics(t, fc, "")
+
+	expectValue(t, families, "fritzbox_up", nil, 1)
+	expectMissing(t, families, "test_uptime_seconds")
+	expectValue(t, families, "fritzbox_exporter_action_unsupported", map[string]string{"service": deviceInfoService, "action": "GetInfo"}, 1)
+	expectMissing(t, families, "test_host_active")
+	if _, ok := value(families, "fritzbox_exporter_action_unsupported", map[string]string{"service": hostsService}); ok {
+		t.Error("failed action marked as unsupported")
+	}
+	expectValue(t, families, "test_wan_bytes_sent", map[string]string{"gateway": "fritz.box"}, 1538445867)
+}
+
+func TestCollectorTimeout(t *testing.T) {
+	fc, _ := startCollector(t, "secret", func(sc *fake.Scenario) {
+		for _, svc := range sc.Services {
+			for _, a := range svc.Actions {
+				if svc.ServiceType == deviceInfoService && a.Name == "GetInfo" {
+					a.Latency = "2s"
+				}
+			}
+		}
+	})
+
+	saved := *flagScrapeTimeoutOffset
+	*flagScrapeTimeoutOffset = 0
+	defer func() { *flagScrapeTimeoutOffset = saved }()
+
+	families := scrapeMetrics(t, fc, "0.3")
+
+	expectValue(t, families, "fritzbox_up", nil, 1)
+	expectMissing(t, families, "test_uptime_seconds")
+	expectValue(t, families, "fritzbox_exporter_action_timed_out", map[string]string{"service": deviceInfoService, "action": "GetInfo"}, 1)
+	expectValue(t, families, "test_wan_bytes_sent", map[string]string{"gateway": "fritz.box"}, 1538445867)
+}
+
+func TestCollectErrorCountedOnce(t *testing.T) {
+	fc, _ := startCollector(t, "secret", func(sc *fake.Scenario) {
+		for _, svc := range sc.Services {
+			for _, a := range svc.Actions {
+				if svc.ServiceType == deviceInfoService && a.Name == "GetInfo" {
+					a.Fault = &fake.Fault{Code: upnp.UpnpActionFailed, Description: "Action Failed"}
+				}
+			}
+		}
+	})
+
+	// a second metric of the failing action
+	extra, err := parseMetrics([]byte(`[{
+		"service": "urn:dslforum-org:service:DeviceInfo:1",
+		"action": "GetInfo",
+		"result": "UpTime",
+		"promDesc": {"fqName": "test_uptime_copy_seconds", "help": "uptime"}
+	}]`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc.SetMetrics(append(fc.metrics(), extra...))
+
+	getInfoErrors := func() float64 {
+		return testutil.ToFloat64(collectErrors.WithLabelValues(deviceInfoService, "GetInfo", reasonSoapFault, "501"))
+	}
+	before := getInfoErrors()
+	scrapeMetrics(t, fc, "")
+
+	if n := getInfoErrors() - before; n != 1 {
+		t.Errorf("%v collection errors of GetInfo, want 1", n)
+	}
+}
+
+func TestScrapeContext(t *testing.T) {
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", 10 * time.Second},
+		{"10", 9500 * time.Millisecond},
+		{"0.8", 500 * time.Millisecond},
+		{"0.5", 500 * time.Millisecond},
+		{"0.2", 200 * time.Millisecond},
+		{"0", 10 * time.Second},
+		{"invalid", 10 * time.Second},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if test.header != "" {
+			req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", test.header)
+		}
+
+		ctx, cancel := scrapeContext(req)
+		deadline, _ := ctx.Deadline()
+		cancel()
+
+		if timeout := time.Until(deadline); timeout < test.want-100*time.Millisecond || timeout > test.want {
+			t.Errorf("header %q: timeout %s, want %s", test.header, timeout, test.want)
+		}
+	}
+}
+
+func TestNestedIndexExpansion(t *testing.T) {
+	const dectService = "urn:dslforum-org:service:X_AVM-DE_Dect:1"
+
+	// two DECT bases with two and one handsets
+	fc, s := startCollector(t, "secret", func(sc *fake.Scenario) {
+		for _, svc := range sc.Services {
+			if svc.ServiceType != dectService {
+				continue
+			}
+
+			svc.StateVariables = append(svc.StateVariables,
+				&fake.StateVariable{Name: "NumberOfHandsets", DataType: "ui2"},
+				&fake.StateVariable{Name: "HandsetIndex", DataType: "ui2"})
+			svc.Actions = append(svc.Actions,
+				&fake.Action{
+					Name:      "GetNumberOfBases",
+					Arguments: []*fake.Argument{{Name: "NewNumberOfEntries", Direction: "out"}},
+					Result:    map[string]string{"NewNumberOfEntries": "2"},
+				},
+				&fake.Action{
+					Name: "GetBase",
+					Arguments: []*fake.Argument{
+						{Name: "NewIndex", Direction: "in"},
+						{Name: "NewNumberOfHandsets", Direction: "out"},
+						{Name: "NewName", Direction: "out"},
+					},
+					Entries: []map[string]string{
+						{"NewNumberOfHandsets": "2", "NewName": "Ground"},
+						{"NewNumberOfHandsets": "1", "NewName": "Attic"},
+					},
+				},
+				&fake.Action{
+					Name: "GetHandset",
+					Arguments: []*fake.Argument{
+						{Name: "NewIndex", Direction: "in"},
+						{Name: "NewHandsetIndex", Direction: "in"},
+						{Name: "NewActive", Direction: "out"},
+					},
+					Entries: []map[string]string{
+						{"NewIndex": "0", "NewHandsetIndex": "0", "NewActive": "1"},
+						{"NewIndex": "0", "NewHandsetIndex": "1", "NewActive": "0"},
+						{"NewIndex": "1", "NewHandsetIndex": "0", "NewActive": "1"},
+					},
+				})
+		}
+	})
+
+	metrics, err := parseMetrics([]byte(`[{
+		"service": "urn:dslforum-org:service:X_AVM-DE_Dect:1",
+		"action": "GetHandset",
+		"actionArguments": [
+			{"name": "NewIndex", "isIndex": true, "providerAction": "GetNumberOfBases", "value": "NumberOfEntries", "label": "base"},
+			{
+				"name": "NewHandsetIndex",
+				"isIndex": true,
+				"providerAction": "GetBase",
+				"providerArguments": [{"name": "NewIndex", "argument": "NewIndex"}],
+				"value": "NumberOfHandsets",
+				"label": "handset",
+				"resultLabels": {"base_name": "Name"}
+			}
+		],
+		"result": "Active",
+		"promDesc": {"fqName": "test_handset_active", "help": "active handsets", "varLabels": ["base", "base_name", "handset"]},
+		"promType": "GaugeValue"
+	}]`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc.SetMetrics(metrics)
+
+	families := scrapeMetrics(t, fc, "")
+	expectValue(t, families, "test_handset_active", map[string]string{"base": "0", "base_name": "ground", "handset": "0"}, 1)
+	expectValue(t, families, "test_handset_active", map[string]string{"base": "0", "base_name": "ground", "handset": "1"}, 0)
+	expectValue(t, families, "test_handset_active", map[string]string{"base": "1", "base_name": "attic", "handset": "0"}, 1)
+	if n := len(families["test_handset_active"].GetMetric()); n != 3 {
+		t.Errorf("%d handsets reported, want 3", n)
+	}
+
+	// the inner provider action is called once per base, the action once per handset
+	for action, want := range map[string]int{"GetNumberOfBases": 1, "GetBase": 2, "GetHandset": 3} {
+		if n := s.Calls(dectService, action); n != want {
+			t.Errorf("%s called %d times, want %d", action, n, want)
+		}
+	}
+}
+
+func TestStateSetAndInfo(t *testing.T) {
+	fc, _ := startCollector(t, "secret", nil)
+
+	metrics, err := parseMetrics([]byte(`[
+	{
+		"service": "urn:schemas-upnp-org:service:WANCommonInterfaceConfig:1",
+		"action": "GetCommonLinkProperties",
+		"kind": "stateset",
+		"result": "PhysicalLinkStatus",
+		"promDesc": {"fqName": "test_link_status", "help": "link status", "varLabels": ["gateway"]}
+	},
+	{
+		"service": "urn:schemas-upnp-org:service:WANCommonInterfaceConfig:1",
+		"action": "GetCommonLinkProperties",
+		"kind": "stateset",
+		"result": "WANAccessType",
+		"states": ["Ethernet", "LTE"],
+		"labels": {"WANAccessType": {"name": "access"}},
+		"promDesc": {"fqName": "test_access_type", "help": "access type", "varLabels": ["gateway"]}
+	},
+	{
+		"service": "urn:dslforum-org:service:DeviceInfo:1",
+		"action": "GetInfo",
+		"kind": "info",
+		"labels": {"Description": {"case": "keep"}},
+		"promDesc": {"fqName": "test_device_info", "help": "device", "varLabels": ["gateway", "model", "Description", "HardwareVersion"]}
+	}
+	]`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc.SetMetrics(metrics)
+	families := scrapeMetrics(t, fc, "")
+
+	// states returns the values of the series by state
+	states := func(name, label string) map[string]float64 {
+		values := make(map[string]float64)
+		for _, m := range families[name].GetMetric() {
+			for _, pair := range m.Label {
+				if pair.GetName() == label {
+					values[pair.GetValue()] = m.GetGauge().GetValue()
+				}
+			}
+		}
+		return values
+	}
+
+	// the states are taken from the allowed values of the service description
+	link := states("test_link_status", "physicallinkstatus")
+	want := map[string]float64{"Up": 1, "Down": 0, "Initializing": 0, "Unavailable": 0}
+	if !reflect.DeepEqual(link, want) {
+		t.Errorf("link states %v, want %v", link, want)
+	}
+
+	// the current state is reported even if it is not one of the configured states
+	access := states("test_access_type", "access")
+	want = map[string]float64{"Ethernet": 0, "LTE": 0, "DSL": 1}
+	if !reflect.DeepEqual(access, want) {
+		t.Errorf("access states %v, want %v", access, want)
+	}
+
+	for name, values := range map[string]map[string]float64{"test_link_status": link, "test_access_type": access} {
+		current := 0
+		for _, v := range values {
+			if v == 1 {
+				current++
+			}
+		}
+		if current != 1 {
+			t.Errorf("%s has %d current states, want 1", name, current)
+		}
+	}
+
+	expectValue(t, families, "test_device_info", map[string]string{
+		"gateway":         "fritz.box",
+		"model":           "FRITZ!Box 7590",
+		"description":     "FRITZ!Box 7590 Release 154.07.29",
+		"hardwareversion": "fritz!box 7590",
+	}, 1)
+	if n := len(families["test_device_info"].GetMetric()); n != 1 {
+		t.Errorf("%d info series reported, want 1", n)
+	}
+}
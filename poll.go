@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// time to wait before the next poll if the services are not loaded yet
+const pollRetryTime = 5 * time.Second
+
+var cacheAgeDesc = prometheus.NewDesc(
+	"fritzbox_exporter_cache_age_seconds",
+	"Age of the cached results of the metrics polled with the given interval.",
+	[]string{"interval"}, nil)
+
+// results of the last poll of a group
+type pollResult struct {
+	metrics  []prometheus.Metric
+	timedOut map[actionKey]bool
+	updated  time.Time
+	up       bool
+	calls    int
+}
+
+// a group of metrics polled with the same interval
+type pollGroup struct {
+	interval time.Duration
+	metrics  []*Metric
+
+	sync.Mutex // protects last
+	last       *pollResult
+}
+
+// poller polls groups of metrics in the background and caches their results.
+type poller struct {
+	fc              *FritzboxCollector
+	groups          []*pollGroup
+	defaultInterval time.Duration
+	stop            chan struct{}
+}
+
+// newPoller groups the metrics by their interval. Metrics without an interval are polled
+// with the default interval.
+func newPoller(fc *FritzboxCollector, metrics []*Metric, defaultInterval time.Duration) *poller {
+	byInterval := make(map[time.Duration]*pollGroup)
+	p := &poller{fc: fc, defaultInterval: defaultInterval, stop: make(chan struct{})}
+
+	for _, m := range metrics {
+		interval := m.PollInterval
+		if interval <= 0 {
+			interval = defaultInterval
+		}
+
+		g, ok := byInterval[interval]
+		if !ok {
+			g = &pollGroup{interval: interval}
+			byInterval[interval] = g
+			p.groups = append(p.groups, g)
+		}
+		g.metrics = append(g.metrics, m)
+	}
+
+	sort.Slice(p.groups, func(i, j int) bool {
+		return p.groups[i].interval < p.groups[j].interval
+	})
+
+	return p
+}
+
+func (p *poller) start() {
+	for _, g := range p.groups {
+		go p.run(g)
+	}
+}
+
+// Stop ends the polling of all groups.
+func (p *poller) Stop() {
+	close(p.stop)
+}
+
+func (p *poller) run(g *pollGroup) {
+	for {
+		wait := g.interval
+		if !p.poll(g) {
+			wait = pollRetryTime
+		}
+
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// poll collects the metrics of the group and caches the results.
+// Returns false if the services are not loaded yet.
+func (p *poller) poll(g *pollGroup) bool {
+	root := p.fc.root()
+	if root == nil {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), g.interval)
+	defer cancel()
+
+	ch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+
+	var metrics []prometheus.Metric
+	go func() {
+		for m := range ch {
+			metrics = append(metrics, m)
+		}
+		close(done)
+	}()
+
+	// the global series limit is applied to the merged results of all groups by collect
+	sc := p.fc.collectMetrics(ctx, root, g.metrics, ch, nil)
+	close(ch)
+	<-done
+
+	g.Lock()
+	g.last = &pollResult{metrics: metrics, timedOut: sc.timedOut, updated: time.Now(), up: sc.up(), calls: sc.soapCalls()}
+	g.Unlock()
+
+	return true
+}
+
+// collect sends the cached results of all groups along with their age, up to the global series limit.
+// Returns false if the last poll of any group got no answer and the number of actions called by the last polls.
+func (p *poller) collect(ch chan<- prometheus.Metric) (bool, int) {
+	now := time.Now()
+	timedOut := make(map[actionKey]bool)
+	up := true
+	calls := 0
+	budget := newSeriesBudget(p.fc.MaxSeries)
+
+	for _, g := range p.groups {
+		g.Lock()
+		last := g.last
+		g.Unlock()
+
+		if last == nil {
+			// not polled yet
+			continue
+		}
+
+		names := make(map[string]string)
+		for _, m := range g.metrics {
+			names[m.Desc.String()] = m.PromDesc.FqName
+		}
+		for _, m := range last.metrics {
+			if budget.take(names[m.Desc().String()]) {
+				ch <- m
+			}
+		}
+		for key := range last.timedOut {
+			timedOut[key] = true
+		}
+		up = up && last.up
+		calls += last.calls
+
+		ch <- prometheus.MustNewConstMetric(cacheAgeDesc, prometheus.GaugeValue, now.Sub(last.updated).Seconds(), g.interval.String())
+	}
+
+	reportTimedOut(ch, timedOut)
+	budget.report(newDedupLogger(p.fc.logger(), p.fc.logDedup()))
+
+	return up, calls
+}
+
+// StartPolling polls the metrics in the background. Metrics without an interval are polled with the
+// given default interval. Collect then only serves the results of the last polls.
+func (fc *FritzboxCollector) StartPolling(defaultInterval time.Duration) {
+	p := newPoller(fc, fc.metrics(), defaultInterval)
+
+	fc.Lock()
+	old := fc.polling
+	if old != nil {
+		p.keepResults(old)
+	}
+	fc.polling = p
+	fc.Unlock()
+
+	if old != nil {
+		old.Stop()
+	}
+
+	p.start()
+}
+
+// keepResults serves the last results of the groups of the old poller until the groups with the
+// same interval are polled the first time. Only the series of metrics still defined in the group
+// are kept.
+func (p *poller) keepResults(old *poller) {
+	for _, g := range p.groups {
+		descs := make(map[string]bool)
+		for _, m := range g.metrics {
+			descs[m.Desc.String()] = true
+		}
+
+		for _, og := range old.groups {
+			if og.interval != g.interval {
+				continue
+			}
+
+			og.Lock()
+			last := og.last
+			og.Unlock()
+			if last == nil {
+				continue
+			}
+
+			kept := *last
+			kept.metrics = nil
+			for _, m := range last.metrics {
+				if descs[m.Desc().String()] {
+					kept.metrics = append(kept.metrics, m)
+				}
+			}
+			g.last = &kept
+		}
+	}
+}
+
+// activePoller returns the poller if background polling is enabled.
+func (fc *FritzboxCollector) activePoller() *poller {
+	fc.Lock()
+	defer fc.Unlock()
+	return fc.polling
+}
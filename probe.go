@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultModule = "default"
+
+// The collectors of probed targets are dropped after they were not used for the idle time. At
+// most maxProbeCollectors are kept, the least recently used one is dropped for a new target.
+const (
+	probeCollectorIdleTime = 1 * time.Hour
+	maxProbeCollectors     = 100
+)
+
+// A Module defines the credentials and metrics used to probe a target. The credentials are sent
+// to any target given by the caller of the probe.
+type Module struct {
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	VerifyTls   bool   `json:"verifyTls"`
+	CAFile      string `json:"caFile"`
+	ProxyUrl    string `json:"proxyUrl"`
+	MetricsFile string `json:"metricsFile"`
+
+	metrics []*Metric
+}
+
+// loadModules reads the module definitions from a JSON file. The given default module is used
+// if the file does not define a module with the name "default". The metrics file of a module
+// defaults to the metrics file of the default module. The external labels are added to the
+// metrics of all modules.
+func loadModules(file string, externalLabels map[string]string, def *Module) (map[string]*Module, error) {
+	modules := make(map[string]*Module)
+
+	if file != "" {
+		jsonData, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading modules file: %s", err)
+		}
+
+		err = json.Unmarshal(jsonData, &modules)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing modules JSON: %s", err)
+		}
+	}
+
+	if _, ok := modules[defaultModule]; !ok {
+		modules[defaultModule] = def
+	}
+
+	for name, m := range modules {
+		if m.metrics != nil {
+			continue
+		}
+
+		if m.MetricsFile == "" || m.MetricsFile == def.MetricsFile {
+			m.MetricsFile = def.MetricsFile
+			m.metrics = def.metrics
+			continue
+		}
+
+		metrics, err := loadMetrics(m.MetricsFile, externalLabels)
+		if err != nil {
+			return nil, fmt.Errorf("module %s: %s", name, err)
+		}
+		m.metrics = metrics
+	}
+
+	return modules, nil
+}
+
+// metricsFiles returns the metrics files used by the modules.
+func metricsFiles(modules map[string]*Module) []string {
+	seen := make(map[string]bool)
+	var files []string
+
+	for _, m := range modules {
+		if !seen[m.MetricsFile] {
+			seen[m.MetricsFile] = true
+			files = append(files, m.MetricsFile)
+		}
+	}
+
+	return files
+}
+
+// targetUrl converts the target parameter of a probe into the URL of the FRITZ!Box.
+// The target can be a host name, a host with port or a full URL.
+func targetUrl(target string) (*url.URL, error) {
+	if !strings.Contains(target, "://") {
+		target = "http://" + target
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("no host in target %s", target)
+	}
+
+	if u.Port() == "" {
+		port := "49000"
+		if u.Scheme == "https" {
+			port = "49443"
+		}
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	u.Path = ""
+	u.RawQuery = ""
+
+	return u, nil
+}
+
+type probeKey struct {
+	module string
+	target string
+}
+
+// collector of a probed target
+type probeCollector struct {
+	fc       *FritzboxCollector
+	lastUsed time.Time
+}
+
+// ProbeHandler serves the metrics of arbitrary targets. For each combination of module and target
+// a FritzboxCollector is created on first use and reused by later probes, until it is idle or
+// evicted by newer targets.
+type ProbeHandler struct {
+	sync.Mutex // protects modules and collectors
+	modules    map[string]*Module
+	collectors map[probeKey]*probeCollector
+}
+
+func NewProbeHandler(modules map[string]*Module) *ProbeHandler {
+	return &ProbeHandler{
+		modules:    modules,
+		collectors: make(map[probeKey]*probeCollector),
+	}
+}
+
+// SetMetrics replaces the metric definitions of all modules using the metrics file.
+func (ph *ProbeHandler) SetMetrics(file string, metrics []*Metric) {
+	ph.Lock()
+	defer ph.Unlock()
+
+	for name, module := range ph.modules {
+		if module.MetricsFile != file {
+			continue
+		}
+
+		module.metrics = metrics
+		for key, pc := range ph.collectors {
+			if key.module == name {
+				pc.fc.SetMetrics(metrics)
+			}
+		}
+	}
+}
+
+// module returns the module with the given name.
+func (ph *ProbeHandler) module(name string) (*Module, bool) {
+	ph.Lock()
+	defer ph.Unlock()
+
+	module, ok := ph.modules[name]
+	return module, ok
+}
+
+// collector returns the cached collector for the module and target or creates a new one.
+func (ph *ProbeHandler) collector(moduleName string, module *Module, target *url.URL) *FritzboxCollector {
+	key := probeKey{module: moduleName, target: target.String()}
+	now := time.Now()
+
+	ph.Lock()
+	defer ph.Unlock()
+
+	ph.dropIdle(now)
+
+	pc, ok := ph.collectors[key]
+	if !ok {
+		ph.dropLeastRecentlyUsed(maxProbeCollectors - 1)
+
+		pc = &probeCollector{fc: &FritzboxCollector{
+			Url:       target.String(),
+			Gateway:   target.Hostname(),
+			Username:  module.Username,
+			Password:  module.Password,
+			VerifyTls: module.VerifyTls,
+			CAFile:    module.CAFile,
+			ProxyUrl:  module.ProxyUrl,
+			Timeout:   *flagGatewayTimeout,
+			Metrics:   module.metrics,
+
+			MaxConcurrency: *flagMaxConcurrency,
+			RateLimit:      *flagRateLimit,
+			Logger:         slog.Default().With("module", moduleName, "target", target.String()),
+
+			MaxSeries:           *flagMaxSeries,
+			MaxSeriesPerMetric:  *flagMaxSeriesPerMetric,
+			SeriesLimitPolicy:   *flagSeriesLimitPolicy,
+			MaxLabelValueLength: *flagMaxLabelValueLength,
+
+			soap: newSoapMetrics(),
+		}}
+		ph.collectors[key] = pc
+	}
+	pc.lastUsed = now
+
+	return pc.fc
+}
+
+// dropIdle drops the collectors not used for the idle time.
+func (ph *ProbeHandler) dropIdle(now time.Time) {
+	for key, pc := range ph.collectors {
+		if now.Sub(pc.lastUsed) > probeCollectorIdleTime {
+			delete(ph.collectors, key)
+		}
+	}
+}
+
+// dropLeastRecentlyUsed drops the least recently used collectors until at most limit are left.
+func (ph *ProbeHandler) dropLeastRecentlyUsed(limit int) {
+	for len(ph.collectors) > limit {
+		var oldest probeKey
+		var oldestUsed time.Time
+		for key, pc := range ph.collectors {
+			if oldestUsed.IsZero() || pc.lastUsed.Before(oldestUsed) {
+				oldest, oldestUsed = key, pc.lastUsed
+			}
+		}
+		delete(ph.collectors, oldest)
+	}
+}
+
+// drop removes the collector of the module and target, unless it was replaced meanwhile.
+func (ph *ProbeHandler) drop(moduleName string, target *url.URL, fc *FritzboxCollector) {
+	key := probeKey{module: moduleName, target: target.String()}
+
+	ph.Lock()
+	defer ph.Unlock()
+
+	if pc, ok := ph.collectors[key]; ok && pc.fc == fc {
+		delete(ph.collectors, key)
+	}
+}
+
+func (ph *ProbeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	target := params.Get("target")
+	if target == "" {
+		http.Error(w, "target parameter is missing", http.StatusBadRequest)
+		return
+	}
+
+	moduleName := params.Get("module")
+	if moduleName == "" {
+		moduleName = defaultModule
+	}
+
+	module, ok := ph.module(moduleName)
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown module %q", moduleName), http.StatusBadRequest)
+		return
+	}
+
+	u, err := targetUrl(target)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid target %q: %s", target, err), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := scrapeContext(r)
+	defer cancel()
+
+	fc := ph.collector(moduleName, module, u)
+	if fc.root() == nil {
+		err = fc.ensureServices(ctx)
+		if err != nil {
+			// do not keep collectors of targets that are no FRITZ!Box
+			ph.drop(moduleName, u, fc)
+			fc.logger().Error("cannot load services", "err", err)
+			http.Error(w, fmt.Sprintf("cannot load services of %s: %s", u, err), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	serveScrape(ctx, w, r, fc)
+}
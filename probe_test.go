@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestProbeCollectorEviction(t *testing.T) {
+	ph := NewProbeHandler(map[string]*Module{defaultModule: {}})
+	module, _ := ph.module(defaultModule)
+
+	target := func(i int) *url.URL {
+		u, _ := targetUrl(fmt.Sprintf("box%d.example", i))
+		return u
+	}
+
+	first := ph.collector(defaultModule, module, target(0))
+	if ph.collector(defaultModule, module, target(0)) != first {
+		t.Error("collector not reused")
+	}
+
+	// the least recently used collector is dropped for a new target
+	for i := 1; i < maxProbeCollectors; i++ {
+		ph.collector(defaultModule, module, target(i))
+	}
+	ph.collector(defaultModule, module, target(0))
+	ph.collector(defaultModule, module, target(maxProbeCollectors))
+
+	if n := len(ph.collectors); n != maxProbeCollectors {
+		t.Errorf("%d collectors, want %d", n, maxProbeCollectors)
+	}
+	if _, ok := ph.collectors[probeKey{module: defaultModule, target: target(1).String()}]; ok {
+		t.Error("least recently used collector kept")
+	}
+	if ph.collector(defaultModule, module, target(0)) != first {
+		t.Error("recently used collector dropped")
+	}
+
+	// idle collectors are dropped
+	for _, pc := range ph.collectors {
+		pc.lastUsed = time.Now().Add(-probeCollectorIdleTime - time.Minute)
+	}
+	ph.collector(defaultModule, module, target(0))
+	if n := len(ph.collectors); n != 1 {
+		t.Errorf("%d collectors after idle time, want 1", n)
+	}
+}
+
+func TestProbeFailedLoad(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	ph := NewProbeHandler(map[string]*Module{defaultModule: {}})
+
+	req := httptest.NewRequest("GET", "/probe?target="+url.QueryEscape(ts.URL), nil)
+	rec := httptest.NewRecorder()
+	ph.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if n := len(ph.collectors); n != 0 {
+		t.Errorf("%d collectors kept after failed load", n)
+	}
+}
+
+func TestProbeSoapMetrics(t *testing.T) {
+	_, ts := startSimulator(t, nil)
+
+	metrics, err := parseMetrics([]byte(testMetrics), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ph := NewProbeHandler(map[string]*Module{defaultModule: {Username: "admin", Password: "secret", metrics: metrics}})
+
+	before := testutil.CollectAndCount(defaultSoapMetrics.requests)
+
+	req := httptest.NewRequest("GET", "/probe?target="+url.QueryEscape(ts.URL), nil)
+	rec := httptest.NewRecorder()
+	ph.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), `fritzbox_soap_requests_total{action="GetInfo",service="urn:dslforum-org:service:DeviceInfo:1"} 1`) {
+		t.Errorf("SOAP metrics of the target not served:\n%s", rec.Body.String())
+	}
+	if n := testutil.CollectAndCount(defaultSoapMetrics.requests); n != before {
+		t.Errorf("calls of the target recorded in the SOAP metrics of the exporter")
+	}
+}
+
+func TestProbeConcurrentFirstLoad(t *testing.T) {
+	s, _ := startSimulator(t, nil)
+
+	// count the loads of the device description
+	var lock sync.Mutex
+	loads := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/igddesc.xml" {
+			lock.Lock()
+			loads++
+			lock.Unlock()
+			// give the other probes time to arrive
+			time.Sleep(50 * time.Millisecond)
+		}
+		s.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	metrics, err := parseMetrics([]byte(testMetrics), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ph := NewProbeHandler(map[string]*Module{defaultModule: {Username: "admin", Password: "secret", metrics: metrics}})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req := httptest.NewRequest("GET", "/probe?target="+url.QueryEscape(ts.URL), nil)
+			rec := httptest.NewRecorder()
+			ph.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Errorf("status %d: %s", rec.Code, rec.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+
+	if loads != 1 {
+		t.Errorf("services loaded %d times, want 1", loads)
+	}
+}
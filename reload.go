@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	reloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "fritzbox_exporter_config_last_reload_successful",
+		Help: "Whether the last reload of the metric definitions was successful.",
+	})
+	reloadSuccessTime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "fritzbox_exporter_config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful reload of the metric definitions.",
+	})
+	reloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "fritzbox_exporter_config_reloads_total",
+		Help: "Number of reloads of the metric definitions by result.",
+	}, []string{"result"})
+	configHash = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "fritzbox_exporter_config_hash",
+		Help: "Hash of the loaded metrics file.",
+	}, []string{"file"})
+)
+
+// A reloader reloads metric definitions when their files change and passes them to the
+// consumers. Files which cannot be parsed are rejected and the old definitions are kept.
+type reloader struct {
+	externalLabels map[string]string // added to the reloaded metrics
+	consumers      []func(file string, metrics []*Metric)
+
+	sync.Mutex                     // protects hashes and serializes reloads
+	hashes     map[string][32]byte // hash of the last content read from each file
+}
+
+// newReloader creates a reloader for the metrics files, which adds the external labels to the
+// metrics. The files are expected to be loaded already.
+func newReloader(externalLabels map[string]string, files ...string) *reloader {
+	r := &reloader{externalLabels: externalLabels, hashes: make(map[string][32]byte)}
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			// watched nevertheless, reported by the next reload
+			r.hashes[file] = [32]byte{}
+			continue
+		}
+
+		hash := sha256.Sum256(data)
+		r.hashes[file] = hash
+		configHash.WithLabelValues(file).Set(hashValue(hash))
+	}
+
+	reloadSuccess.Set(1)
+	reloadSuccessTime.SetToCurrentTime()
+
+	return r
+}
+
+// OnReload registers a function called with the new definitions of a file after each successful reload.
+func (r *reloader) OnReload(consumer func(file string, metrics []*Metric)) {
+	r.consumers = append(r.consumers, consumer)
+}
+
+// files returns the watched files in a stable order.
+func (r *reloader) files() []string {
+	var files []string
+	for file := range r.hashes {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// Reload reloads all files. With force files are reloaded even if their content did not change.
+func (r *reloader) Reload(force bool) error {
+	r.Lock()
+	defer r.Unlock()
+
+	var failed error
+	for _, file := range r.files() {
+		err := r.reloadFile(file, force)
+		if err != nil {
+			slog.Error("cannot reload metric definitions, keeping the old ones", "file", file, "err", err)
+			if failed == nil {
+				failed = fmt.Errorf("%s: %s", file, err)
+			}
+		}
+	}
+
+	return failed
+}
+
+func (r *reloader) reloadFile(file string, force bool) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		reloads.WithLabelValues("failure").Inc()
+		reloadSuccess.Set(0)
+		return err
+	}
+
+	hash := sha256.Sum256(data)
+	if hash == r.hashes[file] && !force {
+		return nil
+	}
+
+	// remember the hash also for invalid files, so they are only reported once
+	r.hashes[file] = hash
+
+	metrics, err := parseMetrics(data, r.externalLabels)
+	if err != nil {
+		reloads.WithLabelValues("failure").Inc()
+		reloadSuccess.Set(0)
+		return err
+	}
+
+	for _, consumer := range r.consumers {
+		consumer(file, metrics)
+	}
+
+	slog.Info("reloaded metric definitions", "file", file, "metrics", len(metrics))
+	reloads.WithLabelValues("success").Inc()
+	reloadSuccess.Set(1)
+	reloadSuccessTime.SetToCurrentTime()
+	configHash.WithLabelValues(file).Set(hashValue(hash))
+
+	return nil
+}
+
+// Watch reloads the files on SIGHUP and checks them for changes in the given interval.
+// An interval of 0 disables checking for changes.
+func (r *reloader) Watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.NewTicker(interval).C
+	}
+
+	for {
+		select {
+		case <-hup:
+			slog.Info("received SIGHUP, reloading metric definitions")
+			r.Reload(true)
+		case <-tick:
+			r.Reload(false)
+		}
+	}
+}
+
+// ServeHTTP reloads the files on POST requests.
+func (r *reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.Reload(true); err != nil {
+		http.Error(w, fmt.Sprintf("failed to reload metric definitions: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintln(w, "metric definitions reloaded")
+}
+
+// hashValue converts the first bytes of the hash into a value usable as metric.
+func hashValue(hash [32]byte) float64 {
+	// use 48 bits, which are exactly representable by a float64
+	return float64(binary.BigEndian.Uint64(hash[:8]) >> 16)
+}
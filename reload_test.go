@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestReloaderMissingFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+
+	r := newReloader(nil, file)
+	var reloaded []*Metric
+	r.OnReload(func(f string, metrics []*Metric) {
+		reloaded = metrics
+	})
+
+	if err := r.Reload(false); err == nil {
+		t.Error("missing file reloaded")
+	}
+
+	if err := ioutil.WriteFile(file, []byte(testMetrics), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(false); err != nil {
+		t.Fatal(err)
+	}
+	if len(reloaded) != 3 {
+		t.Errorf("%d metrics reloaded, want 3", len(reloaded))
+	}
+}
+
+func TestReloadUnknownAction(t *testing.T) {
+	fc, _ := startCollector(t, "secret", nil)
+
+	file := filepath.Join(t.TempDir(), "metrics.json")
+	unknown := strings.Replace(testMetrics, `"action": "GetInfo"`, `"action": "GetUnknown"`, 1)
+	if err := ioutil.WriteFile(file, []byte(unknown), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newReloader(nil, file)
+	r.OnReload(func(f string, metrics []*Metric) {
+		fc.SetMetrics(metrics)
+	})
+
+	// definitions not matching the services are loaded and counted like on startup
+	if err := r.Reload(true); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, scrapeMetrics(t, fc, ""), "fritzbox_exporter_invalid_metric_definitions", nil, 1)
+}
+
+func TestSetMetricsWhilePolling(t *testing.T) {
+	fc, _ := startCollector(t, "secret", nil)
+
+	fc.StartPolling(time.Hour)
+	defer func() { fc.activePoller().Stop() }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := value(scrapeMetrics(t, fc, ""), "test_uptime_seconds", nil); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("metrics never polled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the last results are served until the new definitions are polled
+	fc.SetMetrics(fc.metrics())
+	expectValue(t, scrapeMetrics(t, fc, ""), "test_uptime_seconds", map[string]string{"gateway": "fritz.box"}, 1814400)
+
+	// results of renamed and removed definitions are dropped
+	renamed, err := parseMetrics([]byte(strings.Replace(testMetrics, "test_uptime_seconds", "test_uptime_renamed_seconds", 1)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newPoller(fc, renamed[:2], time.Hour)
+	p.keepResults(fc.activePoller())
+
+	ch := make(chan prometheus.Metric, 100)
+	p.collect(ch)
+	close(ch)
+
+	var names []string
+	for m := range ch {
+		names = append(names, m.Desc().String())
+	}
+	kept := strings.Join(names, "\n")
+	if !strings.Contains(kept, `"test_wan_bytes_sent"`) {
+		t.Errorf("results of unchanged definition dropped:\n%s", kept)
+	}
+	for _, name := range []string{"test_uptime_seconds", "test_host_active"} {
+		if strings.Contains(kept, `"`+name+`"`) {
+			t.Errorf("results of %s kept:\n%s", name, kept)
+		}
+	}
+}
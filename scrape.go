@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	upnp "gitlab.com/dekarl/fritzbox_exporter/fritzbox_upnp"
+)
+
+var actionTimedOutDesc = prometheus.NewDesc(
+	"fritzbox_exporter_action_timed_out",
+	"Set to 1 for each action that did not complete within the scrape timeout.",
+	[]string{"service", "action"}, nil)
+
+// shortest timeout of a scrape left by -scrape-timeout-offset
+const minScrapeTimeout = 500 * time.Millisecond
+
+type actionKey struct {
+	service string
+	action  string
+}
+
+// a single call of an action
+type actionCall struct {
+	service string
+	action  string
+	args    []*upnp.ActionArgument
+	labels  map[string]string // labels taken from the arguments, not part of the key
+	indexed bool              // an argument is an index or taken from the result of an indexed call
+}
+
+// key identifies the call in the result cache
+func (c actionCall) key() string {
+	key := c.service + "|" + c.action
+
+	// for calls with arguments also add argument names and values to key
+	for _, arg := range c.args {
+		key += "|" + arg.Name + "|" + fmt.Sprintf("%v", arg.Value)
+	}
+
+	return key
+}
+
+// vanished returns true if the call failed because the entry of an index vanished since the
+// number of entries was read.
+func (c actionCall) vanished(err error) bool {
+	return c.indexed && len(c.args) > 0 && errors.Is(err, upnp.ErrInvalidArgument)
+}
+
+// logArgs returns the attributes identifying the call in log messages
+func (c actionCall) logArgs() []interface{} {
+	args := []interface{}{"service", c.service, "action", c.action}
+	if len(c.args) > 0 {
+		parts := make([]string, len(c.args))
+		for i, arg := range c.args {
+			parts[i] = fmt.Sprintf("%s=%v", arg.Name, arg.Value)
+		}
+		args = append(args, "arguments", strings.Join(parts, " "))
+	}
+	return args
+}
+
+// cached outcome of a call or of a list download
+type callResult struct {
+	result upnp.Result
+	list   []upnp.Result
+	err    error
+}
+
+// state of a single scrape
+type scrape struct {
+	ctx    context.Context
+	root   *upnp.Root
+	logger *slog.Logger // suppresses messages repeated within logDedupInterval
+	dedup  *dedupState  // state of logger, shared by the scrapes of the collector
+
+	sync.Mutex                        // protects results, timedOut, requests, answered and calls
+	results    map[string]*callResult // cache for the results of all actions called during the scrape
+	timedOut   map[actionKey]bool     // actions that did not complete before the context was done
+	requests   int                    // number of requests made to the FRITZ!Box
+	answered   int                    // number of requests answered by the FRITZ!Box, even with an error
+	calls      int                    // number of actions called
+}
+
+func newScrape(ctx context.Context, root *upnp.Root, logger *slog.Logger, dedup *dedupState) *scrape {
+	return &scrape{
+		ctx:      ctx,
+		root:     root,
+		logger:   newDedupLogger(logger, dedup),
+		dedup:    dedup,
+		results:  make(map[string]*callResult),
+		timedOut: make(map[actionKey]bool),
+	}
+}
+
+// flushLog logs the messages repeated since the interval passed with the number of repetitions.
+func (sc *scrape) flushLog() {
+	sc.dedup.flush(context.Background(), time.Now())
+}
+
+// cached returns the cached outcome of a call.
+func (sc *scrape) cached(key string) (*callResult, bool) {
+	sc.Lock()
+	defer sc.Unlock()
+
+	entry, ok := sc.results[key]
+	return entry, ok
+}
+
+// store caches the outcome of a call and counts its error, so each failed call is counted once.
+func (sc *scrape) store(call actionCall, result upnp.Result, err error) {
+	sc.Lock()
+	sc.results[call.key()] = &callResult{result: result, err: err}
+	sc.Unlock()
+
+	if err != nil && !call.vanished(err) {
+		sc.countError(call, err)
+	}
+}
+
+// storeList caches the outcome of a list download of the call and counts its error.
+func (sc *scrape) storeList(key string, call actionCall, list []upnp.Result, err error) {
+	sc.Lock()
+	sc.results[key] = &callResult{list: list, err: err}
+	sc.Unlock()
+
+	if err != nil {
+		sc.countError(call, err)
+	}
+}
+
+func (sc *scrape) markTimedOut(call actionCall) {
+	sc.Lock()
+	defer sc.Unlock()
+
+	sc.timedOut[actionKey{call.service, call.action}] = true
+}
+
+// logError logs an error of the call. Errors after the scrape timed out are not logged, since these
+// are reported by reportTimeouts.
+func (sc *scrape) logError(msg string, call actionCall, err error, args ...interface{}) {
+	if sc.ctx.Err() != nil || errors.Is(err, errSkippedUnsupported) {
+		return
+	}
+
+	reason, _ := classifyError(err)
+	args = append(append(call.logArgs(), args...), "reason", reason, "err", err)
+	sc.logger.Error(msg, args...)
+}
+
+// countError counts an error of the call. Errors after the scrape timed out are not counted.
+func (sc *scrape) countError(call actionCall, err error) {
+	if sc.ctx.Err() != nil || errors.Is(err, errSkippedUnsupported) {
+		return
+	}
+
+	countError(call.service, call.action, err)
+}
+
+// collectError logs and counts an error found in the results of the call.
+func (sc *scrape) collectError(msg string, call actionCall, err error, args ...interface{}) {
+	sc.logError(msg, call, err, args...)
+	sc.countError(call, err)
+}
+
+// recordCall records whether the FRITZ!Box answered a request.
+func (sc *scrape) recordCall(err error) {
+	if errors.Is(err, upnp.ErrArgumentMismatch) {
+		// the action was not called
+		return
+	}
+
+	answered := err == nil
+	if !answered {
+		switch reason, _ := classifyError(err); reason {
+		case reasonHTTPStatus, reasonUnauthorized, reasonAuthBlocked, reasonSoapFault, reasonParse:
+			answered = true
+		}
+	}
+
+	sc.Lock()
+	defer sc.Unlock()
+
+	sc.requests++
+	if answered {
+		sc.answered++
+	}
+}
+
+func (sc *scrape) countSoapCall() {
+	sc.Lock()
+	defer sc.Unlock()
+
+	sc.calls++
+}
+
+// soapCalls returns the number of actions called during the scrape.
+func (sc *scrape) soapCalls() int {
+	sc.Lock()
+	defer sc.Unlock()
+
+	return sc.calls
+}
+
+// up returns true unless all requests of the scrape failed without an answer of the FRITZ!Box.
+func (sc *scrape) up() bool {
+	sc.Lock()
+	defer sc.Unlock()
+
+	return sc.requests == 0 || sc.answered > 0
+}
+
+// reportTimeouts sends a metric for each action that timed out.
+func (sc *scrape) reportTimeouts(ch chan<- prometheus.Metric) {
+	sc.Lock()
+	defer sc.Unlock()
+
+	reportTimedOut(ch, sc.timedOut)
+}
+
+func reportTimedOut(ch chan<- prometheus.Metric, timedOut map[actionKey]bool) {
+	for key := range timedOut {
+		ch <- prometheus.MustNewConstMetric(actionTimedOutDesc, prometheus.GaugeValue, 1, key.service, key.action)
+	}
+}
+
+// scrapeContext derives the context of a scrape from the timeout Prometheus sends with each
+// scrape. If the header is missing the timeout given by -scrape-timeout is used.
+func scrapeContext(r *http.Request) (context.Context, context.CancelFunc) {
+	timeout := *flagScrapeTimeout
+
+	if v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); v != "" {
+		seconds, err := strconv.ParseFloat(v, 64)
+		if err == nil && seconds <= 0 {
+			err = errors.New("not positive")
+		}
+		if err != nil {
+			slog.Warn("invalid scrape timeout header", "value", v, "err", err)
+		} else {
+			timeout = offsetTimeout(time.Duration(seconds*float64(time.Second)), *flagScrapeTimeoutOffset)
+		}
+	}
+
+	return context.WithTimeout(r.Context(), timeout)
+}
+
+// offsetTimeout subtracts the offset from the scrape timeout, but leaves at least minScrapeTimeout
+// and never more than the scrape timeout itself.
+func offsetTimeout(timeout time.Duration, offset time.Duration) time.Duration {
+	return max(timeout-offset, min(timeout, minScrapeTimeout))
+}
+
+// scrapeCollector collects the metrics of a FritzboxCollector within the context of a single scrape.
+type scrapeCollector struct {
+	fc  *FritzboxCollector
+	ctx context.Context
+}
+
+func (sc *scrapeCollector) Describe(ch chan<- *prometheus.Desc) {
+	sc.fc.Describe(ch)
+}
+
+func (sc *scrapeCollector) Collect(ch chan<- prometheus.Metric) {
+	sc.fc.CollectContext(sc.ctx, ch)
+}
+
+// serveScrape collects the metrics of the collector until the context is done and serves them
+// together with the metrics of the given gatherers.
+func serveScrape(ctx context.Context, w http.ResponseWriter, r *http.Request, fc *FritzboxCollector, gatherers ...prometheus.Gatherer) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(&scrapeCollector{fc: fc, ctx: ctx})
+
+	if fc.soap != nil {
+		// the collector has its own SOAP metrics, which are not part of the gatherers
+		soap := prometheus.NewRegistry()
+		soap.MustRegister(fc.soap.collectors()...)
+		gatherers = append([]prometheus.Gatherer{soap}, gatherers...)
+	}
+
+	// gather the collector first, so errors counted during the scrape are already included
+	gatherers = append([]prometheus.Gatherer{registry}, gatherers...)
+	promhttp.HandlerFor(prometheus.Gatherers(gatherers), promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// scrapeHandler returns a handler serving the metrics of the collector and of the given gatherers.
+func scrapeHandler(fc *FritzboxCollector, gatherers ...prometheus.Gatherer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := scrapeContext(r)
+		defer cancel()
+
+		serveScrape(ctx, w, r, fc, gatherers...)
+	})
+}
+
+// matchServices returns the types of all services matching the pattern, sorted by their
+// instance number. Patterns without * are returned as they are.
+func matchServices(root *upnp.Root, pattern string) []string {
+	if !strings.Contains(pattern, "*") {
+		return []string{pattern}
+	}
+
+	var services []string
+	for serviceType := range root.Services {
+		if ok, _ := path.Match(pattern, serviceType); ok {
+			services = append(services, serviceType)
+		}
+	}
+
+	sort.Slice(services, func(i, j int) bool {
+		ii, erri := strconv.Atoi(serviceInstance(services[i]))
+		ij, errj := strconv.Atoi(serviceInstance(services[j]))
+		if erri != nil || errj != nil || ii == ij {
+			return services[i] < services[j]
+		}
+		return ii < ij
+	})
+
+	return services
+}
+
+// serviceInstance returns the instance number of a service type like
+// urn:dslforum-org:service:WLANConfiguration:2, 1#2 for the second service of the
+// type urn:schemas-upnp-org:service:WANIPConnection:1 in another WAN device.
+func serviceInstance(serviceType string) string {
+	return serviceType[strings.LastIndex(serviceType, ":")+1:]
+}
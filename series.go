@@ -0,0 +1,198 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// policies for metrics exceeding their series limit
+const (
+	policyDrop     = "drop"     // report no series of the metric
+	policyTruncate = "truncate" // report the first series up to the limit
+	policyOther    = "other"    // combine the series beyond the limit into series labeled "other"
+)
+
+// value of the labels taken from results in series combined by the other policy
+const otherLabelValue = "other"
+
+// default maximum length of label values in bytes
+const defaultMaxLabelValueLength = 256
+
+var droppedSeries = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "fritzbox_exporter_series_dropped_total",
+	Help: "Number of series not reported by metric and reason (metric_limit, global_limit or duplicate).",
+}, []string{"metric", "reason"})
+
+// validPolicy returns true for known series limit policies.
+func validPolicy(policy string) bool {
+	switch policy {
+	case policyDrop, policyTruncate, policyOther:
+		return true
+	}
+	return false
+}
+
+// a series of a metric waiting to be reported
+type series struct {
+	valueType prometheus.ValueType
+	value     float64
+	labels    []string
+}
+
+// A seriesGuard limits the series reported by the metric definitions during a collection. The series
+// of each metric are buffered until the metric is complete, so the limits can be applied to all of them.
+// The guard is not safe for concurrent use.
+type seriesGuard struct {
+	fc      *FritzboxCollector
+	ch      chan<- prometheus.Metric
+	logger  *slog.Logger
+	budget  *seriesBudget // global limit of the scrape, nil if applied later to the merged results
+	pending []*series     // series of the current metric
+}
+
+func newSeriesGuard(fc *FritzboxCollector, ch chan<- prometheus.Metric, logger *slog.Logger, budget *seriesBudget) *seriesGuard {
+	return &seriesGuard{fc: fc, ch: ch, logger: logger, budget: budget}
+}
+
+// A seriesBudget applies the global series limit to all series of the metric definitions reported
+// by a scrape, also if they are collected by several polls. The budget is not safe for concurrent use.
+type seriesBudget struct {
+	limit   int            // no limit if not positive
+	total   int            // series reported
+	dropped map[string]int // series beyond the limit by metric
+	order   []string       // metrics with dropped series in the order of their first drop
+}
+
+func newSeriesBudget(limit int) *seriesBudget {
+	return &seriesBudget{limit: limit, dropped: make(map[string]int)}
+}
+
+// take returns true if another series of the metric may be reported.
+func (b *seriesBudget) take(metric string) bool {
+	if b.limit <= 0 || b.total < b.limit {
+		b.total++
+		return true
+	}
+
+	if b.dropped[metric] == 0 {
+		b.order = append(b.order, metric)
+	}
+	b.dropped[metric]++
+	return false
+}
+
+// report logs and counts the series dropped by the limit.
+func (b *seriesBudget) report(logger *slog.Logger) {
+	for _, metric := range b.order {
+		dropped := b.dropped[metric]
+		logger.Warn("global series limit exceeded", "metric", metric, "limit", b.limit, "dropped", dropped)
+		droppedSeries.WithLabelValues(metric, "global_limit").Add(float64(dropped))
+	}
+}
+
+// add buffers a series of the current metric.
+func (g *seriesGuard) add(valueType prometheus.ValueType, value float64, labels []string) {
+	g.pending = append(g.pending, &series{valueType: valueType, value: value, labels: labels})
+}
+
+// flush applies the limits to the buffered series of the metric and sends the remaining ones.
+func (g *seriesGuard) flush(m *Metric) {
+	pending := g.pending
+	g.pending = nil
+
+	limit := m.MaxSeries
+	if limit == 0 {
+		limit = g.fc.MaxSeriesPerMetric
+	}
+	policy := m.SeriesLimitPolicy
+	if policy == "" {
+		policy = g.fc.SeriesLimitPolicy
+	}
+
+	if limit > 0 && len(pending) > limit {
+		dropped := len(pending) - limit
+
+		switch policy {
+		case policyDrop:
+			dropped = len(pending)
+			pending = nil
+		case policyOther:
+			pending = append(pending[:limit], otherSeries(m, pending[limit:])...)
+		default:
+			pending = pending[:limit]
+		}
+
+		g.logger.Warn("series limit of metric exceeded", "metric", m.PromDesc.FqName, "limit", limit, "policy", policy, "dropped", dropped)
+		droppedSeries.WithLabelValues(m.PromDesc.FqName, "metric_limit").Add(float64(dropped))
+	}
+
+	// shortened label values may no longer be unique
+	seen := make(map[string]bool)
+	for _, s := range pending {
+		labels := make([]string, len(s.labels))
+		for i, l := range s.labels {
+			labels[i] = sanitizeLabelValue(l, g.fc.MaxLabelValueLength)
+		}
+
+		key := strings.Join(labels, "\xff")
+		if seen[key] {
+			g.logger.Warn("duplicate series", "metric", m.PromDesc.FqName, "labels", strings.Join(labels, ","))
+			droppedSeries.WithLabelValues(m.PromDesc.FqName, "duplicate").Inc()
+			continue
+		}
+		seen[key] = true
+
+		if g.budget != nil && !g.budget.take(m.PromDesc.FqName) {
+			continue
+		}
+		g.ch <- prometheus.MustNewConstMetric(m.Desc, s.valueType, s.value, labels...)
+	}
+}
+
+// otherSeries combines the series by setting all labels taken from results to "other" and
+// adding up the values of series with the same labels.
+func otherSeries(m *Metric, pending []*series) []*series {
+	var combined []*series
+	groups := make(map[string]*series)
+
+	for _, s := range pending {
+		labels := make([]string, len(s.labels))
+		for i, l := range s.labels {
+			// further labels after the variable labels like the state of a stateset are kept
+			if i < len(m.PromDesc.VarLabels) && isResultLabel(m, m.PromDesc.VarLabels[i]) {
+				l = otherLabelValue
+			}
+			labels[i] = l
+		}
+
+		key := strings.Join(labels, "\xff")
+		if g, ok := groups[key]; ok {
+			g.value += s.value
+			continue
+		}
+		g := &series{valueType: s.valueType, value: s.value, labels: labels}
+		groups[key] = g
+		combined = append(combined, g)
+	}
+
+	return combined
+}
+
+// sanitizeLabelValue replaces invalid UTF-8 and shortens the value to at most maxLength bytes
+// without splitting characters. Values are not shortened if maxLength is not positive.
+func sanitizeLabelValue(value string, maxLength int) string {
+	value = strings.ToValidUTF8(value, "�")
+
+	if maxLength <= 0 || len(value) <= maxLength {
+		return value
+	}
+
+	value = value[:maxLength]
+	for len(value) > 0 && !utf8.ValidString(value) {
+		value = value[:len(value)-1]
+	}
+	return value
+}
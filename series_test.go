@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// a metric with a label taken from the results and a built-in label
+const seriesMetric = `[{
+	"service": "urn:dslforum-org:service:Hosts:1",
+	"action": "GetGenericHostEntry",
+	"result": "Active",
+	"promDesc": {"fqName": "test_series", "help": "series", "varLabels": ["gateway", "HostName"]},
+	"promType": "GaugeValue"
+}]`
+
+func parseSeriesMetric(t *testing.T, name string) *Metric {
+	t.Helper()
+
+	metrics, err := parseMetrics([]byte(strings.Replace(seriesMetric, "test_series", name, 1)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return metrics[0]
+}
+
+// collectedSeries returns the series sent to the channel as labels=value, e.g. fritz.box,a=1.
+func collectedSeries(t *testing.T, ch chan prometheus.Metric) []string {
+	t.Helper()
+
+	close(ch)
+	var result []string
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatal(err)
+		}
+		var labels []string
+		for _, l := range pb.Label {
+			labels = append(labels, l.GetValue())
+		}
+		result = append(result, fmt.Sprintf("%s=%g", strings.Join(labels, ","), pb.GetGauge().GetValue()))
+	}
+	return result
+}
+
+func TestSeriesGuardPolicies(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxSeries   int    // limit of the metric
+		policy      string // policy of the metric
+		fcMaxSeries int    // -max-series-per-metric
+		fcPolicy    string // -series-limit-policy
+		want        []string
+		dropped     float64
+	}{
+		{
+			name: "no limit",
+			want: []string{"fritz.box,a=1", "fritz.box,b=2", "fritz.box,c=3", "fritz.box,d=4"},
+		},
+		{
+			name:      "limit not exceeded",
+			maxSeries: 4,
+			policy:    policyDrop,
+			want:      []string{"fritz.box,a=1", "fritz.box,b=2", "fritz.box,c=3", "fritz.box,d=4"},
+		},
+		{
+			name:      "truncate",
+			maxSeries: 2,
+			policy:    policyTruncate,
+			want:      []string{"fritz.box,a=1", "fritz.box,b=2"},
+			dropped:   2,
+		},
+		{
+			name:      "truncate by default",
+			maxSeries: 3,
+			want:      []string{"fritz.box,a=1", "fritz.box,b=2", "fritz.box,c=3"},
+			dropped:   1,
+		},
+		{
+			name:      "drop",
+			maxSeries: 2,
+			policy:    policyDrop,
+			dropped:   4,
+		},
+		{
+			name:      "other",
+			maxSeries: 2,
+			policy:    policyOther,
+			want:      []string{"fritz.box,a=1", "fritz.box,b=2", "fritz.box,other=7"},
+			dropped:   2,
+		},
+		{
+			name:        "limit and policy of the collector",
+			fcMaxSeries: 1,
+			fcPolicy:    policyOther,
+			want:        []string{"fritz.box,a=1", "fritz.box,other=9"},
+			dropped:     3,
+		},
+		{
+			name:        "limit and policy of the metric take precedence",
+			maxSeries:   3,
+			policy:      policyTruncate,
+			fcMaxSeries: 1,
+			fcPolicy:    policyDrop,
+			want:        []string{"fritz.box,a=1", "fritz.box,b=2", "fritz.box,c=3"},
+			dropped:     1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			droppedSeries.Reset()
+
+			m := parseSeriesMetric(t, "test_series")
+			m.MaxSeries = tt.maxSeries
+			m.SeriesLimitPolicy = tt.policy
+			fc := &FritzboxCollector{MaxSeriesPerMetric: tt.fcMaxSeries, SeriesLimitPolicy: tt.fcPolicy}
+
+			ch := make(chan prometheus.Metric, 10)
+			guard := newSeriesGuard(fc, ch, slog.New(slog.NewTextHandler(io.Discard, nil)), nil)
+			for i, host := range []string{"a", "b", "c", "d"} {
+				guard.add(prometheus.GaugeValue, float64(i+1), []string{"fritz.box", host})
+			}
+			guard.flush(m)
+
+			if got := collectedSeries(t, ch); strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("reported %v, want %v", got, tt.want)
+			}
+			if got := testutil.ToFloat64(droppedSeries.WithLabelValues("test_series", "metric_limit")); got != tt.dropped {
+				t.Errorf("%g series dropped, want %g", got, tt.dropped)
+			}
+		})
+	}
+}
+
+func TestSeriesGuardDuplicates(t *testing.T) {
+	droppedSeries.Reset()
+
+	m := parseSeriesMetric(t, "test_series")
+	fc := &FritzboxCollector{MaxLabelValueLength: 4}
+
+	ch := make(chan prometheus.Metric, 10)
+	guard := newSeriesGuard(fc, ch, slog.New(slog.NewTextHandler(io.Discard, nil)), nil)
+	guard.add(prometheus.GaugeValue, 1, []string{"fritz.box", "laptop-1"})
+	guard.add(prometheus.GaugeValue, 2, []string{"fritz.box", "laptop-2"})
+	guard.add(prometheus.GaugeValue, 3, []string{"fritz.box", "tv"})
+	guard.flush(m)
+
+	want := []string{"frit,lapt=1", "frit,tv=3"}
+	if got := collectedSeries(t, ch); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("reported %v, want %v", got, want)
+	}
+	if got := testutil.ToFloat64(droppedSeries.WithLabelValues("test_series", "duplicate")); got != 1 {
+		t.Errorf("%g duplicates counted, want 1", got)
+	}
+}
+
+func TestSeriesBudget(t *testing.T) {
+	droppedSeries.Reset()
+
+	first := parseSeriesMetric(t, "test_first")
+	second := parseSeriesMetric(t, "test_second")
+	fc := &FritzboxCollector{}
+
+	// the limit applies to the series of all metrics together
+	ch := make(chan prometheus.Metric, 10)
+	budget := newSeriesBudget(3)
+	guard := newSeriesGuard(fc, ch, slog.New(slog.NewTextHandler(io.Discard, nil)), budget)
+	for _, m := range []*Metric{first, second} {
+		guard.add(prometheus.GaugeValue, 1, []string{"fritz.box", "a"})
+		guard.add(prometheus.GaugeValue, 2, []string{"fritz.box", "b"})
+		guard.flush(m)
+	}
+	budget.report(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	if got := collectedSeries(t, ch); len(got) != 3 {
+		t.Errorf("reported %v, want 3 series", got)
+	}
+	if got := testutil.ToFloat64(droppedSeries.WithLabelValues("test_first", "global_limit")); got != 0 {
+		t.Errorf("%g series of the first metric dropped", got)
+	}
+	if got := testutil.ToFloat64(droppedSeries.WithLabelValues("test_second", "global_limit")); got != 1 {
+		t.Errorf("%g series of the second metric dropped, want 1", got)
+	}
+}
+
+func TestSeriesLimitOfPolledGroups(t *testing.T) {
+	droppedSeries.Reset()
+
+	fast := parseSeriesMetric(t, "test_fast")
+	fast.PollInterval = time.Minute
+	slow := parseSeriesMetric(t, "test_slow")
+	slow.PollInterval = time.Hour
+	fc := &FritzboxCollector{MaxSeries: 3, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	// each group stays below the limit, the merged results exceed it
+	p := newPoller(fc, []*Metric{fast, slow}, time.Minute)
+	for _, g := range p.groups {
+		m := g.metrics[0]
+		g.last = &pollResult{
+			metrics: []prometheus.Metric{
+				prometheus.MustNewConstMetric(m.Desc, prometheus.GaugeValue, 1, "fritz.box", "a"),
+				prometheus.MustNewConstMetric(m.Desc, prometheus.GaugeValue, 2, "fritz.box", "b"),
+			},
+			updated: time.Now(),
+			up:      true,
+		}
+	}
+
+	ch := make(chan prometheus.Metric, 10)
+	p.collect(ch)
+
+	var reported []string
+	for _, s := range collectedSeries(t, ch) {
+		// skip the cache age
+		if !strings.HasPrefix(s, "fritz.box,") {
+			continue
+		}
+		reported = append(reported, s)
+	}
+	if len(reported) != 3 {
+		t.Errorf("reported %v, want 3 series", reported)
+	}
+	if got := testutil.ToFloat64(droppedSeries.WithLabelValues("test_slow", "global_limit")); got != 1 {
+		t.Errorf("%g series of the slow group dropped, want 1", got)
+	}
+}
+
+func TestOtherSeries(t *testing.T) {
+	m := parseSeriesMetric(t, "test_series")
+
+	tests := []struct {
+		name    string
+		pending []*series
+		want    []string
+	}{
+		{
+			name:    "no series",
+			pending: nil,
+			want:    nil,
+		},
+		{
+			name: "labels from results combined",
+			pending: []*series{
+				{value: 1, labels: []string{"fritz.box", "a"}},
+				{value: 2, labels: []string{"fritz.box", "b"}},
+			},
+			want: []string{"fritz.box,other=3"},
+		},
+		{
+			name: "built-in labels kept",
+			pending: []*series{
+				{value: 1, labels: []string{"fritz.box", "a"}},
+				{value: 2, labels: []string{"repeater", "b"}},
+				{value: 4, labels: []string{"fritz.box", "c"}},
+			},
+			want: []string{"fritz.box,other=5", "repeater,other=2"},
+		},
+		{
+			name: "further labels kept",
+			pending: []*series{
+				{value: 1, labels: []string{"fritz.box", "a", "up"}},
+				{value: 0, labels: []string{"fritz.box", "a", "down"}},
+				{value: 1, labels: []string{"fritz.box", "b", "up"}},
+			},
+			want: []string{"fritz.box,other,up=2", "fritz.box,other,down=0"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, s := range otherSeries(m, tt.pending) {
+				got = append(got, fmt.Sprintf("%s=%g", strings.Join(s.labels, ","), s.value))
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("otherSeries() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeLabelValue(t *testing.T) {
+	tests := []struct {
+		value     string
+		maxLength int
+		want      string
+	}{
+		{"laptop", 0, "laptop"},
+		{"laptop", 6, "laptop"},
+		{"laptop", 3, "lap"},
+		{"laptop", -1, "laptop"},
+		{"wohnzimmer-tür", 13, "wohnzimmer-t"}, // ü is not split
+		{"wohnzimmer-tür", 14, "wohnzimmer-tü"},
+		{"bad\xffvalue", 0, "bad�value"},
+		{"bad\xffvalue", 4, "bad"}, // the replacement is not split either
+		{"", 3, ""},
+	}
+
+	for _, tt := range tests {
+		if got := sanitizeLabelValue(tt.value, tt.maxLength); got != tt.want {
+			t.Errorf("sanitizeLabelValue(%q, %d) = %q, want %q", tt.value, tt.maxLength, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// types of transforms
+const (
+	transformScale    = "scale"    // multiply with factor and add offset
+	transformMap      = "map"      // map strings to numbers
+	transformRegex    = "regex"    // extract a part of a string
+	transformDateTime = "dateTime" // convert a date to unix seconds
+)
+
+// TR-064 dateTime values come with or without time zone
+var dateTimeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05"}
+
+// A Transform converts the result of an action before it is reported.
+type Transform struct {
+	Type        string             `json:"type"`
+	Factor      float64            `json:"factor"`      // scale: factor to multiply with, 1 if not given
+	Offset      float64            `json:"offset"`      // scale: offset to add after multiplying
+	Values      map[string]float64 `json:"values"`      // map: number for each string
+	Default     *float64           `json:"default"`     // map: number for strings not in values, error if not given
+	Pattern     string             `json:"pattern"`     // regex: pattern the string has to match
+	Replacement string             `json:"replacement"` // regex: template for the result, "$1" if not given
+	Layout      string             `json:"layout"`      // dateTime: layout of the date as in time.Parse
+
+	regexp *regexp.Regexp
+}
+
+// init checks the transform and prepares it for use.
+func (t *Transform) init() error {
+	switch t.Type {
+	case transformScale:
+		if t.Factor == 0 {
+			t.Factor = 1
+		}
+	case transformMap:
+		if len(t.Values) == 0 {
+			return fmt.Errorf("map transform without values")
+		}
+	case transformRegex:
+		re, err := regexp.Compile(t.Pattern)
+		if err != nil {
+			return err
+		}
+		t.regexp = re
+
+		if t.Replacement == "" {
+			t.Replacement = "$1"
+		}
+	case transformDateTime:
+	default:
+		return fmt.Errorf("unknown transform type %q", t.Type)
+	}
+
+	return nil
+}
+
+// apply the transform to a value
+func (t *Transform) apply(val interface{}) (interface{}, error) {
+	switch t.Type {
+	case transformScale:
+		f, err := toFloat(val)
+		if err != nil {
+			return nil, err
+		}
+		return f*t.Factor + t.Offset, nil
+
+	case transformMap:
+		s := fmt.Sprintf("%v", val)
+		if f, ok := t.Values[s]; ok {
+			return f, nil
+		}
+		if t.Default != nil {
+			return *t.Default, nil
+		}
+		return nil, fmt.Errorf("no mapping for %q", s)
+
+	case transformRegex:
+		s := fmt.Sprintf("%v", val)
+		match := t.regexp.FindStringSubmatchIndex(s)
+		if match == nil {
+			return nil, fmt.Errorf("%q does not match %s", s, t.Pattern)
+		}
+		extracted := string(t.regexp.ExpandString(nil, t.Replacement, s, match))
+
+		// extracted numbers can be reported directly or scaled by further transforms
+		if f, err := strconv.ParseFloat(extracted, 64); err == nil {
+			return f, nil
+		}
+		return extracted, nil
+
+	case transformDateTime:
+		s := fmt.Sprintf("%v", val)
+		layouts := dateTimeLayouts
+		if t.Layout != "" {
+			layouts = []string{t.Layout}
+		}
+
+		for _, layout := range layouts {
+			if ts, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+				return float64(ts.Unix()), nil
+			}
+		}
+		return nil, fmt.Errorf("cannot parse date %q", s)
+	}
+
+	return nil, fmt.Errorf("unknown transform type %q", t.Type)
+}
+
+// transform applies all transforms of the metric to the value
+func (m *Metric) transform(val interface{}) (interface{}, error) {
+	for _, t := range m.Transforms {
+		var err error
+		val, err = t.apply(val)
+		if err != nil {
+			return nil, fmt.Errorf("%s transform: %s", t.Type, err)
+		}
+	}
+
+	return val, nil
+}
+
+// toFloat converts numbers, booleans and strings containing numbers to float64.
+func toFloat(val interface{}) (float64, error) {
+	switch tval := val.(type) {
+	case uint64:
+		return float64(tval), nil
+	case int64:
+		return float64(tval), nil
+	case float64:
+		return tval, nil
+	case bool:
+		if tval {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		return strconv.ParseFloat(tval, 64)
+	}
+
+	return 0, fmt.Errorf("unknown type %T", val)
+}
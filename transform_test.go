@@ -0,0 +1,113 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTransformApply(t *testing.T) {
+	defaultValue := -1.0
+
+	tests := []struct {
+		name      string
+		transform Transform
+		val       interface{}
+		want      interface{}
+		wantErr   bool
+	}{
+		{"scale", Transform{Type: transformScale, Factor: 8}, uint64(125), 1000.0, false},
+		{"scale with offset", Transform{Type: transformScale, Factor: 0.1, Offset: -40}, int64(650), 25.0, false},
+		{"offset only", Transform{Type: transformScale, Offset: 273.15}, "-273.15", 0.0, false},
+		{"scale boolean", Transform{Type: transformScale, Factor: 2}, true, 2.0, false},
+		{"scale text", Transform{Type: transformScale, Factor: 2}, "fast", nil, true},
+		{"map", Transform{Type: transformMap, Values: map[string]float64{"Up": 1, "Down": 0}}, "Up", 1.0, false},
+		{"map number", Transform{Type: transformMap, Values: map[string]float64{"2": 5}}, uint64(2), 5.0, false},
+		{"map default", Transform{Type: transformMap, Values: map[string]float64{"Up": 1}, Default: &defaultValue}, "Training", -1.0, false},
+		{"map without default", Transform{Type: transformMap, Values: map[string]float64{"Up": 1}}, "Training", nil, true},
+		{"regex number", Transform{Type: transformRegex, Pattern: `(\d+) kbit/s`}, "up to 100000 kbit/s", 100000.0, false},
+		{"regex text", Transform{Type: transformRegex, Pattern: `^(\w+)-`, Replacement: "$1"}, "vdsl-2", "vdsl", false},
+		{"regex no match", Transform{Type: transformRegex, Pattern: `(\d+) kbit/s`}, "unknown", nil, true},
+		{"dateTime", Transform{Type: transformDateTime}, "2021-03-01T12:00:00+01:00", 1614596400.0, false},
+		{"dateTime layout", Transform{Type: transformDateTime, Layout: "02.01.2006 15:04 MST"}, "01.03.2021 11:00 UTC", 1614596400.0, false},
+		{"dateTime invalid", Transform{Type: transformDateTime}, "yesterday", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := tt.transform
+			if err := tr.init(); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := tr.apply(tt.val)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("apply(%v) error = %v, want error %v", tt.val, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("apply(%v) = %v (%T), want %v (%T)", tt.val, got, got, tt.want, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransformLocalDateTime(t *testing.T) {
+	tr := Transform{Type: transformDateTime}
+	if err := tr.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	// dates without time zone are in the local time of the exporter
+	got, err := tr.apply("2021-03-01T12:00:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := float64(time.Date(2021, 3, 1, 12, 0, 0, 0, time.Local).Unix())
+	if got != want {
+		t.Errorf("apply() = %v, want %v", got, want)
+	}
+}
+
+func TestTransformInit(t *testing.T) {
+	tests := []struct {
+		name      string
+		transform Transform
+		wantErr   bool
+	}{
+		{"scale", Transform{Type: transformScale}, false},
+		{"map without values", Transform{Type: transformMap}, true},
+		{"invalid regex", Transform{Type: transformRegex, Pattern: "("}, true},
+		{"unknown type", Transform{Type: "round"}, true},
+	}
+
+	for _, tt := range tests {
+		tr := tt.transform
+		if err := tr.init(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: init() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestMetricTransform(t *testing.T) {
+	// the regex extracts a number which is scaled afterwards
+	m := &Metric{Transforms: []*Transform{
+		{Type: transformRegex, Pattern: `(\d+) kbit/s`},
+		{Type: transformScale, Factor: 1000},
+	}}
+	for _, tr := range m.Transforms {
+		if err := tr.init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := m.transform("100 kbit/s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 100000.0 {
+		t.Errorf("transform() = %v, want 100000", got)
+	}
+
+	if _, err := m.transform("offline"); err == nil {
+		t.Errorf("transform of a value not matching succeeded")
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	upnp "gitlab.com/dekarl/fritzbox_exporter/fritzbox_upnp"
+)
+
+var invalidMetricsDesc = prometheus.NewDesc(
+	"fritzbox_exporter_invalid_metric_definitions",
+	"Number of metric definitions not matching the services of the FRITZ!Box.",
+	nil, nil)
+
+// validateMetrics checks the metric definitions against the services of the FRITZ!Box
+// and returns all problems found.
+func validateMetrics(root *upnp.Root, metrics []*Metric) []error {
+	var problems []error
+
+	for _, m := range metrics {
+		for _, problem := range validateMetric(root, m) {
+			problems = append(problems, fmt.Errorf("%s: %s", m.PromDesc.FqName, problem))
+		}
+	}
+
+	return problems
+}
+
+// checkMetrics logs all problems of the metric definitions and returns the number of invalid definitions.
+func checkMetrics(logger *slog.Logger, root *upnp.Root, metrics []*Metric) int {
+	for _, problem := range validateMetrics(root, metrics) {
+		logger.Warn("invalid metric definition", "problem", problem)
+	}
+
+	return countInvalid(root, metrics)
+}
+
+// countInvalid returns the number of metrics with at least one problem.
+func countInvalid(root *upnp.Root, metrics []*Metric) int {
+	count := 0
+	for _, m := range metrics {
+		if len(validateMetric(root, m)) > 0 {
+			count++
+		}
+	}
+	return count
+}
+
+func validateMetric(root *upnp.Root, m *Metric) []string {
+	var problems []string
+
+	switch m.PromType {
+	case "", "CounterValue", "GaugeValue", "UntypedValue":
+	default:
+		problems = append(problems, fmt.Sprintf("unknown promType %s", m.PromType))
+	}
+
+	services := matchServices(root, m.Service)
+	if len(services) == 0 {
+		problems = append(problems, fmt.Sprintf("no service matches %s", m.Service))
+	}
+
+	for _, serviceType := range services {
+		service, ok := root.Services[serviceType]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("service %s not found", serviceType))
+			continue
+		}
+
+		action, ok := service.Actions[m.Action]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("action %s not found in service %s", m.Action, serviceType))
+			continue
+		}
+
+		problems = append(problems, validateAction(m, service, action)...)
+	}
+
+	return problems
+}
+
+// validateAction checks the arguments, results and labels of the metric against the action.
+func validateAction(m *Metric, service *upnp.Service, action *upnp.Action) []string {
+	var problems []string
+	name := service.ServiceType + "#" + action.Name
+
+	given := make(map[string]bool)
+	for _, aa := range m.ActionArguments {
+		if arg, ok := action.ArgumentMap[aa.Name]; !ok || arg.Direction != "in" {
+			problems = append(problems, fmt.Sprintf("%s has no input argument %s", name, aa.Name))
+		}
+		if given[aa.Name] {
+			problems = append(problems, fmt.Sprintf("argument %s of %s given twice", aa.Name, name))
+		}
+		given[aa.Name] = true
+
+		if aa.ProviderAction != "" {
+			provider, ok := service.Actions[aa.ProviderAction]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("provider action %s not found in service %s", aa.ProviderAction, service.ServiceType))
+			} else {
+				problems = append(problems, validateProvider(aa, service, provider)...)
+			}
+		}
+	}
+
+	for _, arg := range action.Arguments {
+		if arg.Direction == "in" && !given[arg.Name] {
+			problems = append(problems, fmt.Sprintf("%s requires input argument %s", name, arg.Name))
+		}
+	}
+
+	if m.Source == sourceList {
+		// results and labels are fields of the list entries, which are not described
+		if outArgument(action, m.ListPath) == nil {
+			problems = append(problems, fmt.Sprintf("%s has no result %s", name, m.ListPath))
+		}
+		return problems
+	}
+
+	for _, f := range m.Filter {
+		if outArgument(action, f.Result) == nil {
+			problems = append(problems, fmt.Sprintf("%s has no result %s used in filter", name, f.Result))
+		}
+	}
+
+	if m.Kind != kindInfo && m.Aggregate != aggregateCount {
+		arg := outArgument(action, m.Result)
+		if arg == nil {
+			problems = append(problems, fmt.Sprintf("%s has no result %s", name, m.Result))
+		} else if problem := checkDataType(m, arg.StateVariable); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+
+	for _, l := range m.PromDesc.VarLabels {
+		if isExtraLabel(m, l) {
+			continue
+		}
+
+		if outArgument(action, l) == nil {
+			problems = append(problems, fmt.Sprintf("%s has no result %s used as label", name, l))
+		}
+	}
+
+	return problems
+}
+
+// validateProvider checks the arguments and results of the provider action of the argument.
+func validateProvider(aa *ActionArg, service *upnp.Service, provider *upnp.Action) []string {
+	var problems []string
+	name := service.ServiceType + "#" + provider.Name
+
+	if outArgument(provider, aa.Value) == nil {
+		problems = append(problems, fmt.Sprintf("provider action %s has no result %s", aa.ProviderAction, aa.Value))
+	}
+	for l, result := range aa.ResultLabels {
+		if outArgument(provider, result) == nil {
+			problems = append(problems, fmt.Sprintf("provider action %s has no result %s used as label %s", aa.ProviderAction, result, l))
+		}
+	}
+
+	given := make(map[string]bool)
+	for _, pa := range aa.ProviderArguments {
+		if arg, ok := provider.ArgumentMap[pa.Name]; !ok || arg.Direction != "in" {
+			problems = append(problems, fmt.Sprintf("%s has no input argument %s", name, pa.Name))
+		}
+		given[pa.Name] = true
+	}
+	for _, arg := range provider.Arguments {
+		if arg.Direction == "in" && !given[arg.Name] {
+			problems = append(problems, fmt.Sprintf("%s requires input argument %s", name, arg.Name))
+		}
+	}
+
+	return problems
+}
+
+// checkDataType checks that the result can be converted into a value of the type of the metric.
+// Counters need unsigned numbers, gauges and untyped metrics also accept signed numbers, booleans
+// and strings compared with okValue.
+func checkDataType(m *Metric, sv *upnp.StateVariable) string {
+	if m.Kind == kindStateSet || len(m.Transforms) > 0 || sv == nil {
+		// states can have any type, transforms are checked while collecting
+		return ""
+	}
+
+	promType := m.PromType
+	if promType == "" {
+		promType = "UntypedValue"
+	}
+
+	switch sv.DataType {
+	case "ui1", "ui2", "ui4":
+		return ""
+	case "i4", "boolean":
+		if promType == "CounterValue" {
+			return fmt.Sprintf("result %s has type %s, which cannot be a CounterValue", m.Result, sv.DataType)
+		}
+		return ""
+	case "string":
+		if promType == "CounterValue" {
+			return fmt.Sprintf("result %s is a string, which cannot be a CounterValue", m.Result)
+		}
+		if m.OkValue == "" {
+			return fmt.Sprintf("result %s is a string, which needs okValue or transforms for a %s", m.Result, promType)
+		}
+		return ""
+	default:
+		return fmt.Sprintf("result %s has type %s, which needs a transform for a %s", m.Result, sv.DataType, promType)
+	}
+}
+
+// outArgument returns the output argument of the action for the state variable.
+func outArgument(action *upnp.Action, stateVariable string) *upnp.Argument {
+	for _, arg := range action.Arguments {
+		if arg.Direction == "out" && arg.RelatedStateVariable == stateVariable {
+			return arg
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	upnp "gitlab.com/dekarl/fritzbox_exporter/fritzbox_upnp"
+)
+
+func TestCheckDataType(t *testing.T) {
+	tests := []struct {
+		dataType string
+		metric   Metric
+		wantErr  bool
+	}{
+		{"ui4", Metric{PromType: "CounterValue"}, false},
+		{"ui2", Metric{PromType: "GaugeValue"}, false},
+		{"ui1", Metric{}, false},
+		{"i4", Metric{PromType: "GaugeValue"}, false},
+		{"i4", Metric{PromType: "CounterValue"}, true},
+		{"boolean", Metric{PromType: "UntypedValue"}, false},
+		{"boolean", Metric{PromType: "CounterValue"}, true},
+		{"string", Metric{PromType: "GaugeValue"}, true},
+		{"string", Metric{}, true},
+		{"string", Metric{PromType: "GaugeValue", OkValue: "Up"}, false},
+		{"string", Metric{PromType: "CounterValue", OkValue: "Up"}, true},
+		{"string", Metric{PromType: "CounterValue", Transforms: []*Transform{{Type: transformScale}}}, false},
+		{"string", Metric{PromType: "GaugeValue", Kind: kindStateSet}, false},
+		{"dateTime", Metric{PromType: "GaugeValue"}, true},
+		{"dateTime", Metric{PromType: "GaugeValue", Transforms: []*Transform{{Type: transformDateTime}}}, false},
+	}
+
+	for _, tt := range tests {
+		m := tt.metric
+		m.Result = "Status"
+		problem := checkDataType(&m, &upnp.StateVariable{Name: "Status", DataType: tt.dataType})
+		if (problem != "") != tt.wantErr {
+			t.Errorf("%s as %q (okValue %q, kind %q): problem %q, want problem %v", tt.dataType, m.PromType, m.OkValue, m.Kind, problem, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateDataTypes(t *testing.T) {
+	fc, _ := startCollector(t, "secret", nil)
+
+	metrics, err := parseMetrics([]byte(`[
+	{
+		"service": "urn:schemas-upnp-org:service:WANCommonInterfaceConfig:1",
+		"action": "GetTotalBytesSent",
+		"result": "TotalBytesSent",
+		"promDesc": {"fqName": "test_bytes_sent", "help": "bytes sent"},
+		"promType": "CounterValue"
+	},
+	{
+		"service": "urn:schemas-upnp-org:service:WANCommonInterfaceConfig:1",
+		"action": "GetCommonLinkProperties",
+		"result": "PhysicalLinkStatus",
+		"promDesc": {"fqName": "test_link_status", "help": "link status"},
+		"promType": "GaugeValue"
+	},
+	{
+		"service": "urn:schemas-upnp-org:service:WANCommonInterfaceConfig:1",
+		"action": "GetCommonLinkProperties",
+		"result": "PhysicalLinkStatus",
+		"okValue": "Up",
+		"promDesc": {"fqName": "test_link_up", "help": "link up"},
+		"promType": "GaugeValue"
+	},
+	{
+		"service": "urn:schemas-upnp-org:service:WANCommonInterfaceConfig:1",
+		"action": "GetCommonLinkProperties",
+		"result": "PhysicalLinkStatus",
+		"okValue": "Up",
+		"promDesc": {"fqName": "test_link_up_total", "help": "link up"},
+		"promType": "CounterValue"
+	}
+	]`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var problems []string
+	for _, problem := range validateMetrics(fc.root(), metrics) {
+		problems = append(problems, problem.Error())
+	}
+	if len(problems) != 2 ||
+		!strings.HasPrefix(problems[0], "test_link_status: result PhysicalLinkStatus is a string") ||
+		!strings.HasPrefix(problems[1], "test_link_up_total: result PhysicalLinkStatus is a string") {
+		t.Errorf("unexpected problems %q", problems)
+	}
+	if n := countInvalid(fc.root(), metrics); n != 2 {
+		t.Errorf("%d invalid definitions, want 2", n)
+	}
+}